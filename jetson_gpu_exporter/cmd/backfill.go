@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"bufio"
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var backfillCmd = &cobra.Command{
+	Use:   "backfill [file...]",
+	Short: "Convert timestamped tegrastats logs to OpenMetrics for promtool",
+	Long: `Convert tegrastats logs, or recordings made by the record command, to OpenMetrics
+with the exporter's metric names and the time of every line, and write it to stdout.
+Reads stdin when no file is given:
+
+  jetson_exporter backfill --timezone Asia/Shanghai tegrastats.log > tegrastats.om
+  promtool tsdb create-blocks-from openmetrics tegrastats.om ./data
+
+Lines need the timestamp tegrastats prints since JetPack 4.6, or the receive time of a
+recording. The --collector.<name>, --metrics.* and --tegrastats-interval flags apply.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timezone, _ := cmd.Flags().GetString("timezone")
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return err
+		}
+		readers := []io.Reader{os.Stdin}
+		if len(args) > 0 {
+			readers = nil
+		}
+		for _, path := range args {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			// a file without a final newline must not run into the next one
+			readers = append(readers, file, strings.NewReader("\n"))
+		}
+		w := bufio.NewWriter(os.Stdout)
+		lines, err := exporter.Backfill(
+			io.MultiReader(readers...),
+			w,
+			exporter.CollectorOptions{
+				LegacyNames: viper.GetBool("metrics.legacy-names"),
+				Interval:    time.Duration(viper.GetInt("tegrastats-interval")) * time.Millisecond,
+				StatsWindow: viper.GetDuration("metrics.stats-window"),
+			},
+			enabledCollectors(),
+			loc,
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("Converted %d lines", lines)
+		return w.Flush()
+	},
+}
+
+func init() {
+	backfillCmd.Flags().String("timezone", "Local", "Time zone of the board that printed the tegrastats timestamps, e.g. UTC or Asia/Shanghai.")
+	rootCmd.AddCommand(backfillCmd)
+}
@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"github.com/bearboy/jetson_prometheus_exporter/build"
 	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/simulator"
 	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 )
 
 var (
@@ -26,19 +29,144 @@ var rootCmd = &cobra.Command{
 		filePath := viper.GetString("tegrastats-log-file")
 		cleanFileInterval := viper.GetInt("logfile-cleanup-interval-hours")
 		//启动tegrastats
-		tegrastats := exporter.Tegrastats{Interval: interval, LogPath: filePath}
-		tegrastats.Start(interval, filePath)
-		e := exporter.NewExporter(
+		paths := exporter.Paths{
+			Sysfs:  viper.GetString("path.sysfs"),
+			Procfs: viper.GetString("path.procfs"),
+			Rootfs: viper.GetString("path.rootfs"),
+		}
+		source := newSource(viper.GetString("source"), interval, filePath, cleanFileInterval, paths)
+		if err := source.Start(); err != nil {
+			log.Fatalf("start %s source: %s", viper.GetString("source"), err)
+		}
+		e, err := exporter.NewExporter(
 			interval,
-			filePath,
-			cleanFileInterval,
-			&tegrastats,
+			source,
+			exporter.CollectorOptions{
+				Paths:       paths,
+				LegacyNames: viper.GetBool("metrics.legacy-names"),
+				StatsWindow: viper.GetDuration("metrics.stats-window"),
+				StaleAfter:  viper.GetDuration("metrics.stale-after"),
+			},
+			enabledCollectors(),
 		)
+		if err != nil {
+			log.Fatalf("create exporter: %s", err)
+		}
+		if err := e.SetInfluxTags(viper.GetStringMapString("influx.tags")); err != nil {
+			log.Fatalf("influx tags: %s", err)
+		}
 		e.InitPrometheus()
+		if u := viper.GetString("remote-write.url"); u != "" {
+			err := e.PushTo(exporter.RemoteWriteOptions{
+				URL:            u,
+				Interval:       viper.GetDuration("remote-write.interval"),
+				Timeout:        viper.GetDuration("remote-write.timeout"),
+				Retries:        viper.GetInt("remote-write.retries"),
+				Username:       viper.GetString("remote-write.username"),
+				Password:       viper.GetString("remote-write.password"),
+				BearerToken:    viper.GetString("remote-write.bearer-token"),
+				ExternalLabels: viper.GetStringMapString("remote-write.external-labels"),
+				Format:         viper.GetString("remote-write.format"),
+				QueueDir:       viper.GetString("remote-write.queue-dir"),
+				QueueMaxBytes:  viper.GetInt64("remote-write.queue-max-mb") << 20,
+				QueueMaxAge:    viper.GetDuration("remote-write.queue-max-age"),
+			})
+			if err != nil {
+				log.Fatalf("start remote_write: %s", err)
+			}
+		}
+		if broker := viper.GetString("mqtt.broker"); broker != "" {
+			err := e.PublishTo(exporter.MQTTOptions{
+				Broker:      broker,
+				ClientID:    viper.GetString("mqtt.client-id"),
+				Username:    viper.GetString("mqtt.username"),
+				Password:    viper.GetString("mqtt.password"),
+				Topic:       viper.GetString("mqtt.topic"),
+				StatusTopic: viper.GetString("mqtt.status-topic"),
+				QoS:         byte(viper.GetInt("mqtt.qos")),
+				Retain:      viper.GetBool("mqtt.retain"),
+				CACert:      viper.GetString("mqtt.ca-cert"),
+				ClientCert:  viper.GetString("mqtt.client-cert"),
+				ClientKey:   viper.GetString("mqtt.client-key"),
+			})
+			if err != nil {
+				log.Fatalf("start mqtt: %s", err)
+			}
+		}
+		if endpoint := viper.GetString("otlp.endpoint"); endpoint != "" {
+			err := e.ExportTo(exporter.OTLPOptions{
+				Endpoint:           endpoint,
+				Protocol:           viper.GetString("otlp.protocol"),
+				Insecure:           viper.GetBool("otlp.insecure"),
+				Interval:           viper.GetDuration("otlp.interval"),
+				Timeout:            viper.GetDuration("otlp.timeout"),
+				Headers:            viper.GetStringMapString("otlp.headers"),
+				ResourceAttributes: viper.GetStringMapString("otlp.resource-attributes"),
+			})
+			if err != nil {
+				log.Fatalf("start otlp: %s", err)
+			}
+		}
+		if u := viper.GetString("influx.url"); u != "" {
+			err := e.WriteInfluxTo(exporter.InfluxOptions{
+				URL:                u,
+				Org:                viper.GetString("influx.org"),
+				Bucket:             viper.GetString("influx.bucket"),
+				Token:              viper.GetString("influx.token"),
+				FlushInterval:      viper.GetDuration("influx.flush-interval"),
+				Timeout:            viper.GetDuration("influx.timeout"),
+				MaxBufferedSamples: viper.GetInt("influx.max-buffered-samples"),
+			})
+			if err != nil {
+				log.Fatalf("start influx: %s", err)
+			}
+		}
 		e.RunServer(viper.GetString("jetson-bind-address"))
 	},
 }
 
+// newSource returns the source selected by --source, falling back to sysfs
+// when tegrastats has to be started but is not installed
+func newSource(mode string, interval int, filePath string, cleanFileInterval int, paths exporter.Paths) exporter.Source {
+	if mode == exporter.ModeSysfs {
+		return exporter.NewSysfs(interval, paths)
+	}
+	if strings.HasPrefix(mode, exporter.ModeReplay+":") {
+		recording := strings.TrimPrefix(mode, exporter.ModeReplay+":")
+		return exporter.NewReplay(recording, viper.GetFloat64("replay.speed"), viper.GetBool("replay.loop"), interval)
+	}
+	if strings.HasPrefix(mode, exporter.ModeSimulate+":") {
+		board := strings.TrimPrefix(mode, exporter.ModeSimulate+":")
+		return exporter.NewSimulator(interval, board, viper.GetString("simulate.pattern"), viper.GetInt64("simulate.seed"))
+	}
+	tegrastats := &exporter.Tegrastats{
+		Interval:          interval,
+		LogPath:           filePath,
+		CleanFileInterval: cleanFileInterval,
+		Mode:              mode,
+		Binary:            viper.GetString("tegrastats.binary"),
+		Paths:             paths,
+	}
+	if mode != exporter.ModeAttach && !tegrastats.Available() {
+		log.Warnf("tegrastats not found, reading sysfs instead")
+		return exporter.NewSysfs(interval, paths)
+	}
+	return tegrastats
+}
+
+// enabledCollectors returns the collectors left enabled by the --collector.<name>
+// and --no-collector.<name> flags or the collector.<name> config keys
+func enabledCollectors() []string {
+	var names []string
+	for _, name := range exporter.CollectorNames() {
+		if viper.GetBool("collector."+name) && !viper.GetBool("no-collector."+name) {
+			names = append(names, name)
+		}
+	}
+	log.Printf("Enabled collectors: %v", names)
+	return names
+}
+
 // Execute runs the command
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
@@ -55,6 +183,62 @@ func init() {
 	flags.StringP("tegrastats-log-file", "p", pwd, "Dumps the output of tegrastats to <filename>.")
 	flags.IntP("tegrastats-interval", "i", 1000, "Samples the information in <milliseconds>")
 	flags.IntP("logfile-cleanup-interval-hours", "l", 1, "After how many hours we want to clean up tegrastats_logfile(argument above).")
+	flags.StringP("source", "s", exporter.ModeLogfile, "Where samples come from: logfile (tegrastats writes tegrastats-log-file), stream (read tegrastats stdout, no log file), attach (read tegrastats-log-file written by a tegrastats someone else manages), sysfs (read /sys and /proc, no tegrastats), replay:<file> (play back a recording made by the record command) or simulate:<board> (generate the tegrastats lines of "+strings.Join(simulator.BoardNames(), ", ")+")")
+	flags.Float64("replay.speed", 1, "Replay speed of --source=replay:<file>, 1 is real time and 10 ten times faster.")
+	flags.Bool("replay.loop", false, "Start --source=replay:<file> over when it reaches the end.")
+	flags.String("simulate.pattern", "idle", "Load pattern of --source=simulate:<board>: "+strings.Join(simulator.PatternNames(), ", ")+".")
+	flags.Int64("simulate.seed", 1, "Random seed of --source=simulate:<board>, the same seed gives the same run.")
+	defaultPaths := exporter.DefaultPaths()
+	flags.String("path.sysfs", defaultPaths.Sysfs, "sysfs mountpoint.")
+	flags.String("path.procfs", defaultPaths.Procfs, "procfs mountpoint.")
+	flags.String("path.rootfs", defaultPaths.Rootfs, "rootfs mountpoint, used to find the tegrastats binary.")
+	flags.String("tegrastats.binary", "", "Path of the tegrastats binary (default: searched under path.rootfs and $PATH).")
+	flags.Bool("metrics.legacy-names", false, "Export the old metric names (nvidia_jetson_ram{statistic=\"used\"} in MB, ...) instead of the base-unit ones.")
+	flags.Duration("metrics.stats-window", 15*time.Second, "How far back the min/max/avg gauges of GPU load, CPU load, rail power and temperatures look, usually the scrape interval.")
+	flags.Duration("metrics.stale-after", 0, "Drop the hardware metrics when the last tegrastats sample is older than this, e.g. 30s, so Prometheus marks them stale (default 0, never).")
+	flags.String("remote-write.url", "", "Also push the metrics to this Prometheus remote_write endpoint, e.g. http://prometheus:9090/api/v1/write, for boards that cannot be scraped.")
+	flags.Duration("remote-write.interval", 15*time.Second, "How often the metrics are pushed to remote-write.url.")
+	flags.Duration("remote-write.timeout", 10*time.Second, "Timeout of one remote_write request.")
+	flags.Int("remote-write.retries", 3, "How often a remote_write request failing with a network error, 429 or 5xx is retried before its samples are dropped.")
+	flags.String("remote-write.username", "", "Basic auth user of remote-write.url.")
+	flags.String("remote-write.password", "", "Basic auth password of remote-write.url.")
+	flags.String("remote-write.bearer-token", "", "Bearer token of remote-write.url.")
+	flags.StringToString("remote-write.external-labels", nil, "Labels added to every pushed series, e.g. device=jetson-07,site=plant-2.")
+	flags.String("remote-write.format", exporter.PushFormatRemoteWrite, "Push format: remote-write (snappy protobuf) or json (one {\"metric\",\"values\",\"timestamps\"} object per line, as VictoriaMetrics /api/v1/import takes it).")
+	flags.String("remote-write.queue-dir", "", "Keep pushed samples in an on-disk queue in this directory until the endpoint took them, and send them in order once it is reachable again. A Prometheus receiver needs out_of_order_time_window to accept samples older than its head block, it rejects them otherwise (see nvidia_jetson_remote_write_replay_rejected_samples_total).")
+	flags.Int64("remote-write.queue-max-mb", 256, "Size limit of the on-disk queue, the oldest samples are dropped beyond it.")
+	flags.Duration("remote-write.queue-max-age", 24*time.Hour, "Samples older than this are dropped from the on-disk queue instead of sent (0 keeps them until the size limit).")
+	flags.String("mqtt.broker", "", "Also publish every sample to this MQTT broker, e.g. tcp://gateway:1883 or ssl://gateway:8883.")
+	flags.String("mqtt.client-id", "", "MQTT client id (default jetson_exporter_<hostname>).")
+	flags.String("mqtt.username", "", "MQTT user name.")
+	flags.String("mqtt.password", "", "MQTT password.")
+	flags.String("mqtt.topic", "jetson/{hostname}/stats", "Topic of the samples as JSON; with {metric}, e.g. jetson/{hostname}/{metric}, every value goes to its own topic.")
+	flags.String("mqtt.status-topic", "jetson/{hostname}/status", "Topic holding a retained online, and offline as last will once the exporter is gone.")
+	flags.Int("mqtt.qos", 0, "MQTT QoS of the published messages: 0, 1 or 2.")
+	flags.Bool("mqtt.retain", false, "Retain the last sample on the broker.")
+	flags.String("mqtt.ca-cert", "", "PEM file of the CA verifying an ssl:// broker.")
+	flags.String("mqtt.client-cert", "", "PEM file of the client certificate presented to the broker.")
+	flags.String("mqtt.client-key", "", "PEM file of the key of mqtt.client-cert.")
+	flags.String("otlp.endpoint", "", "Also export the metrics to this OpenTelemetry Collector, e.g. otel-collector:4317 for grpc or http://otel-collector:4318 for http/protobuf.")
+	flags.String("otlp.protocol", exporter.OTLPProtocolGRPC, "OTLP protocol: grpc or http/protobuf.")
+	flags.Bool("otlp.insecure", false, "Talk plain text to an otlp.endpoint given as host:port over grpc.")
+	flags.Duration("otlp.interval", 15*time.Second, "How often the metrics are exported to otlp.endpoint.")
+	flags.Duration("otlp.timeout", 10*time.Second, "Timeout of one OTLP export.")
+	flags.StringToString("otlp.headers", nil, "Headers sent with every export, e.g. authorization=Bearer <token>.")
+	flags.StringToString("otlp.resource-attributes", nil, "Resource attributes added to the detected host.name, device.model.name and jetson.l4t.version, e.g. deployment.environment=plant-2.")
+	flags.String("influx.url", "", "Also write every sample to this InfluxDB v2 server, e.g. http://influxdb:8086.")
+	flags.String("influx.org", "", "InfluxDB organization.")
+	flags.String("influx.bucket", "", "InfluxDB bucket.")
+	flags.String("influx.token", "", "InfluxDB API token.")
+	flags.StringToString("influx.tags", nil, "Tags added to every point, e.g. site=plant-2 (host defaults to the hostname).")
+	flags.Duration("influx.flush-interval", 10*time.Second, "How often the buffered samples are written to InfluxDB.")
+	flags.Duration("influx.timeout", 10*time.Second, "Timeout of one InfluxDB write.")
+	flags.Int("influx.max-buffered-samples", 10000, "Samples kept while InfluxDB is unreachable, the oldest are dropped beyond it.")
+	for _, name := range exporter.CollectorNames() {
+		enabled := exporter.CollectorDefaultEnabled(name)
+		flags.Bool("collector."+name, enabled, fmt.Sprintf("Enable the %s collector.", name))
+		flags.Bool("no-collector."+name, false, fmt.Sprintf("Disable the %s collector.", name))
+	}
 	viper.BindPFlags(flags)
 
 }
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+var parseCmd = &cobra.Command{
+	Use:   "parse [file...]",
+	Short: "Convert tegrastats logs to JSON lines or CSV",
+	Long: `Parse tegrastats logs, or recordings made by the record command, and write one record
+per line to stdout. Reads stdin when no file is given:
+
+  jetson_exporter parse --format csv < tegrastats.log > run.csv
+
+Every record has the line number, the time tegrastats printed (or the receive time of a
+recording) and one column per value, e.g. ram_used_bytes, cpu0_load_percent,
+gr3d_freq_utilization_percent, vdd_in_current_mw or temp_gpu_celsius.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		var w recordWriter
+		switch format {
+		case "json":
+			w = &jsonWriter{w: bufio.NewWriter(os.Stdout)}
+		case "csv":
+			w = &csvWriter{w: csv.NewWriter(os.Stdout)}
+		default:
+			return fmt.Errorf("unknown format %q, want json or csv", format)
+		}
+		if len(args) == 0 {
+			if err := parseLog(os.Stdin, "stdin", w); err != nil {
+				return err
+			}
+		}
+		for _, path := range args {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = parseLog(file, path, w)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	parseCmd.Flags().StringP("format", "f", "json", "Output format: json (one object per line) or csv.")
+	rootCmd.AddCommand(parseCmd)
+}
+
+// parsedRecord is one parsed line of a log.
+type parsedRecord struct {
+	line   int
+	time   string
+	fields []tegrastats.Field
+}
+
+type recordWriter interface {
+	Write(rec parsedRecord) error
+	Flush() error
+}
+
+// parseLog parses every line of r; unrecognised tokens are reported on stderr and the rest of the line is kept.
+func parseLog(r io.Reader, name string, w recordWriter) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	n := 0
+	for scanner.Scan() {
+		n++
+		at, line, recorded := exporter.ParseRecord(scanner.Text())
+		sample, err := tegrastats.Parse(line)
+		if err != nil {
+			log.Warnf("%s:%d: %s", name, n, err)
+		}
+		rec := parsedRecord{line: n, fields: tegrastats.Flatten(sample)}
+		if sample.TimePresent {
+			rec.time = sample.Time.Format(time.RFC3339)
+		} else if recorded {
+			rec.time = at.Format(time.RFC3339Nano)
+		}
+		if len(rec.fields) == 0 && rec.time == "" {
+			continue
+		}
+		if err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// jsonWriter writes one JSON object per record, with the columns in Flatten order.
+type jsonWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonWriter) Write(rec parsedRecord) error {
+	fmt.Fprintf(j.w, `{"line":%d`, rec.line)
+	if rec.time != "" {
+		fmt.Fprintf(j.w, `,"time":%q`, rec.time)
+	}
+	for _, field := range rec.fields {
+		name, _ := json.Marshal(field.Name)
+		fmt.Fprintf(j.w, ",%s:%s", name, strconv.FormatFloat(field.Value, 'f', -1, 64))
+	}
+	_, err := j.w.WriteString("}\n")
+	return err
+}
+
+func (j *jsonWriter) Flush() error {
+	return j.w.Flush()
+}
+
+// csvWriter keeps every record until Flush, because the header is the union of the columns
+// of all lines: cores go off and engines come and go between the lines of a log.
+type csvWriter struct {
+	w       *csv.Writer
+	records []parsedRecord
+}
+
+func (c *csvWriter) Write(rec parsedRecord) error {
+	c.records = append(c.records, rec)
+	return nil
+}
+
+func (c *csvWriter) Flush() error {
+	columns := []string{"line", "time"}
+	index := make(map[string]int)
+	for _, rec := range c.records {
+		for _, field := range rec.fields {
+			if _, ok := index[field.Name]; !ok {
+				index[field.Name] = len(columns)
+				columns = append(columns, field.Name)
+			}
+		}
+	}
+	if err := c.w.Write(columns); err != nil {
+		return err
+	}
+	for _, rec := range c.records {
+		row := make([]string, len(columns))
+		row[0] = strconv.Itoa(rec.line)
+		row[1] = rec.time
+		for _, field := range rec.fields {
+			row[index[field.Name]] = strconv.FormatFloat(field.Value, 'f', -1, 64)
+		}
+		if err := c.w.Write(row); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
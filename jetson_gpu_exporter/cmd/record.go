@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var recordCmd = &cobra.Command{
+	Use:   "record",
+	Short: "Record the raw tegrastats lines with their receive time",
+	Long: `Record the raw tegrastats lines with their receive time until interrupted,
+to be served again later with --source=replay:<file>`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, _ := cmd.Flags().GetString("out")
+		duration, _ := cmd.Flags().GetDuration("duration")
+		file, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("open recording: %s", err)
+		}
+		defer file.Close()
+
+		// read the tegrastats stdout, or the logfile of a tegrastats someone else manages
+		mode := exporter.ModeStream
+		if viper.GetString("source") == exporter.ModeAttach {
+			mode = exporter.ModeAttach
+		}
+		var mu sync.Mutex
+		lines := 0
+		source := &exporter.Tegrastats{
+			Interval: viper.GetInt("tegrastats-interval"),
+			LogPath:  viper.GetString("tegrastats-log-file"),
+			Mode:     mode,
+			Binary:   viper.GetString("tegrastats.binary"),
+			Paths: exporter.Paths{
+				Sysfs:  viper.GetString("path.sysfs"),
+				Procfs: viper.GetString("path.procfs"),
+				Rootfs: viper.GetString("path.rootfs"),
+			},
+			Raw: func(line string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if err := exporter.WriteRecord(file, time.Now(), line); err != nil {
+					log.Errorf("write recording: %s", err)
+				}
+				lines++
+			},
+		}
+		if err := source.Start(); err != nil {
+			log.Fatalf("start tegrastats: %s", err)
+		}
+		log.Printf("Recording tegrastats to %s, press Ctrl+C to stop", out)
+
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		var timeout <-chan time.Time
+		if duration > 0 {
+			timeout = time.After(duration)
+		}
+		select {
+		case <-quit:
+		case <-timeout:
+		}
+		source.Stop()
+		mu.Lock()
+		log.Printf("Recorded %d lines to %s", lines, out)
+		mu.Unlock()
+	},
+}
+
+func init() {
+	recordCmd.Flags().StringP("out", "o", "run.tsl", "File the recording is appended to.")
+	recordCmd.Flags().Duration("duration", 0, "Stop recording after this long (default: until interrupted).")
+	rootCmd.AddCommand(recordCmd)
+}
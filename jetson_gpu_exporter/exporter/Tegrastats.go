@@ -1,326 +1,259 @@
 package exporter
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-        "errors"
+	"time"
 )
-type runCmd func(cmd *exec.Cmd) error
 
-var command runCmd
+const (
+	// ModeLogfile lets tegrastats write LogFile and follows the lines appended to it.
+	ModeLogfile = "logfile"
+	// ModeStream reads the stdout of a tegrastats child process and keeps the latest sample in memory.
+	ModeStream = "stream"
+	// ModeAttach follows a logfile written by a tegrastats instance someone else manages,
+	// without ever starting, stopping or truncating it.
+	ModeAttach = "attach"
+)
 
-type CpuInfo struct {
-	index  int
-	status int
-	load   int
-	freq   int
-        governor string
-}
-type VddInfo struct {
-	index   int
-	label   string
-	current int
-	average int
-}
 type Tegrastats struct {
-	Interval int
-	LogPath  string
-	LogFile  string
-}
+	Interval          int
+	LogPath           string
+	LogFile           string
+	CleanFileInterval int
+	Mode              string
+	// Binary is the tegrastats executable; when empty it is searched for under Paths.Rootfs.
+	Binary string
+	Paths  Paths
+	// Raw, when set, is called with every line read from tegrastats before it is parsed.
+	Raw func(line string)
 
-//Start
-// Call Tegrastats to generate the file to be monitored
-func (e *Tegrastats) Start(interval int, path string) {
-	getTegrastatsBin()
-	e.LogFile = filepath.Join(path, "tegrastats.log")
-	e.Interval = interval
-	cmdStr := fmt.Sprintf("tegrastats --interval %d --logfile %s &", interval, e.LogFile)
-	log.Println("exec cmd " + cmdStr)
-	runCommand(cmdStr)
+	latest     latestSample
+	supervisor *supervisor
+	follower   *follower
+	cleanJob   *cron.Cron
 }
 
-//Stop
-//exec tegrastats --stop cmd
-func (e *Tegrastats) Stop() {
-	cmdStr := "tegrastats --stop"
-	log.Println("exec cmd " + cmdStr)
-	log.Println("Shutdown tegrastats Server start ")
-	runCommand(cmdStr)
-	log.Println("Shutdown tegrastats Server end ")
+// Start
+// Call Tegrastats to generate the file to be monitored, or to stream its output in ModeStream.
+// The tegrastats process is supervised and restarted when it exits.
+func (e *Tegrastats) Start() error {
+	e.LogFile = e.logFile()
+	if e.Mode == ModeAttach {
+		log.Printf("attach to tegrastats logfile %s", e.LogFile)
+		e.follow()
+		return nil
+	}
+	bin := e.binary()
+	if bin == "" {
+		bin = "tegrastats"
+	}
+	args := []string{"--interval", strconv.Itoa(e.Interval)}
+	if e.Mode == ModeStream {
+		e.supervisor = newSupervisor(bin, args, e.readStream)
+		return e.supervisor.start()
+	}
+	e.supervisor = newSupervisor(bin, append(args, "--logfile", e.LogFile), nil)
+	if err := e.supervisor.start(); err != nil {
+		return err
+	}
+	e.follow()
+	log.Println("start job to clean up logfile ......  ")
+	e.cleanJob = cron.New(cron.WithSeconds())
+	spec := fmt.Sprintf("0 0 */%d * * *", e.CleanFileInterval)
+	_, err := e.cleanJob.AddFunc(spec, func() {
+		e.cleanUpFile()
+	})
+	if err != nil {
+		return fmt.Errorf("start job to clean up logfile fail error: %s", err)
+	}
+	e.cleanJob.Start()
+	return nil
 }
 
-//Read
-// read tegrastats.log
-func (e *Tegrastats) Read() string {
-	cmdStr := "tail -1 " + e.LogFile
-	cmd := exec.Command("sh", "-c", cmdStr)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("combined out:%s\n", string(out))
-		log.Errorf("cmd.Run() failed with %s\n", err)
-		return ""
-	} else {
-		log.Printf("combined out:%s\n", string(out))
-		return string(out)
+// readStream reads the samples of a tegrastats stdout until it is closed
+func (e *Tegrastats) readStream(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		e.readLine(scanner.Text())
 	}
 }
 
-//cleanUpFile
-// clean up tegrastats.log
-func (e *Tegrastats) cleanUpFile() {
-	cmdStr := "cat /dev/null > " + e.LogFile
-	runCommand(cmdStr)
-	log.Println("cleanUpFile end ......")
+// follow reads the samples appended to LogFile until Stop
+func (e *Tegrastats) follow() {
+	e.follower = newFollower(e.LogFile, time.Duration(e.Interval)*time.Millisecond, e.readLine)
+	e.follower.start()
 }
-func runCommand(cmdStr string) {
-	cmd := exec.Command("sh", "-c", cmdStr)
-	err := cmd.Run()
+
+func (e *Tegrastats) readLine(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if e.Raw != nil {
+		e.Raw(line)
+	}
+	sample, err := tegrastats.Parse(line)
 	if err != nil {
-		log.Errorf("cmd.Run() %s failed with %s\n", cmdStr, err)
+		log.Debugf("parse tegrastats line: %s", err)
+		// a garbled line must not replace the last good sample
+		if !hasData(sample) {
+			return
+		}
 	}
+	e.latest.store(sample)
 }
 
-func getTegrastatsBin() bool {
-	var binPaths = []string{"/usr/bin/tegrastats", "/home/nvidia/tegrastats"}
-	for _, path := range binPaths {
-		_, err := os.Stat(path)
-		if err == nil {
-			return true
-		}
-	}
-	//panic("tegrastats not found in (/usr/bin/tegrastats,/home/nvidia/tegrastats)")
-	return false
+// hasData reports whether the parser recognised any group of the line.
+func hasData(sample *tegrastats.Sample) bool {
+	return sample.RAM.Present || sample.Swap.Present || sample.IRAM.Present || sample.CPU.Present || sample.MTS.Present ||
+		len(sample.Engines) > 0 || len(sample.Rails) > 0 || len(sample.Temps) > 0
 }
 
-//GetSwap
-//SWAP X/Y (cached Z)
-//X = Amount of SWAP in use in megabytes.
-//Y = Total amount of SWAP available for applications.
-//Z = Amount of SWAP cached in megabytes.
-func GetSwap(text string) map[string]string {
-	var swapMap = make(map[string]string)
-	matchRegxp := regexp.MustCompile("SWAP (\\d+)\\/(\\d+)(\\w)B( ?)\\(cached (\\d+)(\\w)B\\)")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		swapMap["use"] = params[1]
-		swapMap["tot"] = params[2]
-		swapMap["unit"] = params[3]
-		swapMap["cached"] = params[5] + params[6]
+// logFile returns LogPath/tegrastats.log, or LogPath itself when it names a file
+func (e *Tegrastats) logFile() string {
+	if e.LogPath == "" || IsDir(e.LogPath) {
+		return filepath.Join(e.LogPath, "tegrastats.log")
 	}
-	return swapMap
+	return e.LogPath
 }
 
-// GetIRam
-//IRAM X/Y (lfb Z)
-//IRAM is memory local to the video hardware engine.
-//X = Amount of IRAM memory in use, in kilobytes.
-//Y = Total amount of IRAM memory available.
-//Z = Size of the largest free block.
-func GetIRam(text string) map[string]string {
-	var ramMap = make(map[string]string)
-	matchRegxp := regexp.MustCompile("IRAM (\\d+)\\/(\\d+)(\\w)B( ?)\\(lfb (\\d+)(\\w)B\\)")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		ramMap["use"] = params[1]
-		ramMap["tot"] = params[2]
-		ramMap["unit"] = params[3]
-		ramMap["lfb"] = params[5]
+// Stop
+// terminate the tegrastats instance started by Start; other instances keep running
+func (e *Tegrastats) Stop() {
+	if e.follower != nil {
+		e.follower.stopFollowing()
 	}
-	return ramMap
+	if e.supervisor == nil {
+		return
+	}
+	log.Println("Shutdown tegrastats Server start ")
+	e.supervisor.stop()
+	if e.cleanJob != nil {
+		e.cleanJob.Stop()
+	}
+	log.Println("Shutdown tegrastats Server end ")
 }
 
-//GetRam
-//RAM X/Y (lfb NxZ)
-//Largest Free Block (lfb) is a statistic about the memory allocator.
-//It refers to the largest contiguous block of physical memory
-//that can currently be allocated: at most 4 MB.
-//It can become smaller with memory fragmentation.
-//The physical allocations in virtual memory can be bigger.
-//X = Amount of RAM in use in MB.
-//Y = Total amount of RAM available for applications.
-//N = The number of free blocks of this size.
-//Z = is the size of the largest free block.
-func GetRam(text string) map[string]string {
-	var ramMap = make(map[string]string)
-	matchRegxp := regexp.MustCompile("RAM (\\d+)\\/(\\d+)(\\w)B( ?)\\(lfb (\\d+)x(\\d+)(\\w)B\\)")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		ramMap["use"] = params[1]
-		ramMap["tot"] = params[2]
-		ramMap["unit"] = params[3]
-		ramMap["nblock"] = params[5]
-		ramMap["size"] = params[6]
-	}
-	return ramMap
+// Latest
+// returns the last sample read from tegrastats
+func (e *Tegrastats) Latest() *tegrastats.Sample {
+	return e.latest.Latest()
 }
 
-//GetCpu
-//CPU [X%,Y%, , ]@Z or CPU [X%@Z, Y%@Z,...]
-//X and Y are rough approximations based on time spent
-//in the system idle process as reported by the Linux kernel in /proc/stat.
-//X = Load statistics for each of the CPU cores relative to the
-//current running frequency Z, or 'off' in case a core is currently powered down.
-//Y = Load statistics for each of the CPU cores relative to the
-//current running frequency Z, or 'off' in case a core is currently powered down.
-//Z = CPU frequency in megahertz. Goes up or down dynamically depending on the CPU workload.
+// Subscribe implements Source
+func (e *Tegrastats) Subscribe(fn func(*tegrastats.Sample)) {
+	e.latest.Subscribe(fn)
+}
 
-func ExecCommand(cmd string, command runCmd) (ans string) {
-	//cmdAndArgs := strings.Fields("")
-	//cmdAndArgs = append(cmdAndArgs, cmd)
-	log.Infoln("11111111111111111111111")
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmdstr := exec.Command("sh", "-c",cmd)
-	log.Infoln("the cmdStr: ",cmdstr)
-	cmdstr.Stdout = &stdout
-	cmdstr.Stderr = &stderr
-	//err := command(cmdstr)
-	err := cmdstr.Run()
-	log.Infoln("the 11111111----1-1111")
-	//log.Infoln("the cmd.Stdout: ", stdout.String())
-	if err != nil {
-		exitCode := 1
-		var exitError *exec.ExitError
-		if errors.As(err, &exitError) {
-			exitCode = exitError.ExitCode()
-		}
-		log.Infoln("%w: command filed . code :%d | command: %s | stdout: %s | stderr: %s", err, exitCode, cmd, stdout.String(), stderr.String())
-		return ""
+// lastSampleTime returns when tegrastats last produced a sample:
+// the last line read in ModeStream, otherwise the modification time of tegrastats.log
+func (e *Tegrastats) lastSampleTime() time.Time {
+	if e.Mode == ModeStream {
+		return e.latest.load().at
 	}
-	ans = stdout.String()
-	log.Infoln("the ans.....",ans)
-	return ans
-}
-func IsFile(path string) bool {
-	return !IsDir(path)
-}
-func IsDir(path string) bool {
-	s, err := os.Stat(path)
+	info, err := os.Stat(e.LogFile)
 	if err != nil {
-		return false
+		return time.Time{}
 	}
-	return s.IsDir()
+	return info.ModTime()
 }
-func GetCpu(text string) map[string]CpuInfo {
-	var cpuMap = make(map[string]CpuInfo)
-	matchRegxp := regexp.MustCompile("CPU \\[(.*)\\]")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		cpus := strings.Split(params[1], ",")
-		for i, value := range cpus {
-			cpuInfo := new(CpuInfo)
-			cpuInfo.index = i
-			if value == "off" {
-				cpuInfo.status = 0
-			} else {
-				cpuInfo.status = 1
-				//Frequency
-				matchFreq := regexp.MustCompile("\\b(\\d+)%@(\\d+)")
-				paramsFreq := matchFreq.FindStringSubmatch(value)
-				if paramsFreq != nil {
-					val, _ := strconv.Atoi(paramsFreq[1])
-					cpuInfo.load = val
-					val, _ = strconv.Atoi(paramsFreq[2])
-					cpuInfo.freq = val
-				}
-				governName := "/sys/devices/system/cpu/cpu" + strconv.Itoa(i) + "/cpufreq/scaling_governor"
-				log.Infoln("the governName: ",governName)
-				if IsFile(governName) {
-					log.Infoln("cat cpu scaling_governor========")
-					governCmd := "cat /sys/devices/system/cpu/cpu" + strconv.Itoa(i) + "/cpufreq/scaling_governor"
-					govern :=ExecCommand(governCmd,command)
-					if govern != "" {
-						cpuInfo.governor = govern
-					}else {
-						cpuInfo.governor=""
-					}
-				} else {
-					return cpuMap
-				}
-			}
-			cpuMap[strconv.Itoa(i)] = *cpuInfo
+
+var (
+	tegrastatsUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tegrastats", "up"),
+		"Whether the tegrastats process started by the exporter is running.",
+		nil, nil,
+	)
+	tegrastatsRestartsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tegrastats", "restarts_total"),
+		"How often the tegrastats process was restarted after it exited.",
+		nil, nil,
+	)
+	lastSampleAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_sample_age_seconds"),
+		"Seconds since tegrastats produced the last sample.",
+		nil, nil,
+	)
+)
+
+// Describe implements prometheus.Collector for the tegrastats self-metrics
+func (e *Tegrastats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tegrastatsUpDesc
+	ch <- tegrastatsRestartsDesc
+	ch <- lastSampleAgeDesc
+}
+
+// Collect implements prometheus.Collector for the tegrastats self-metrics.
+// Up and restarts are only known for the instance the exporter started itself.
+func (e *Tegrastats) Collect(ch chan<- prometheus.Metric) {
+	if e.supervisor != nil {
+		up := 0
+		_, running, restarts := e.supervisor.status()
+		if running {
+			up = 1
 		}
+		ch <- prometheus.MustNewConstMetric(tegrastatsUpDesc, prometheus.GaugeValue, float64(up))
+		ch <- prometheus.MustNewConstMetric(tegrastatsRestartsDesc, prometheus.CounterValue, float64(restarts))
 	}
-	return cpuMap
-}
-func GetGr3dFreq(text string) map[string]string {
-	var gr3dFreqMap = make(map[string]string)
-	matchRegxp := regexp.MustCompile("GR3D_FREQ ([0-9]*)%@?([0-9]*)?")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		gr3dFreqMap["use"] = params[1]
-		gr3dFreqMap["frequency"] = params[2]
+	if last := e.lastSampleTime(); !last.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastSampleAgeDesc, prometheus.GaugeValue, time.Since(last).Seconds())
 	}
-	return gr3dFreqMap
 }
-func GetEmcFreq(text string) map[string]string {
-	var emcMap = make(map[string]string)
-	matchRegxp := regexp.MustCompile("EMC_FREQ ([0-9]*)%@?([0-9]*)?")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		emcMap["use"] = params[1]
-		emcMap["frequency"] = params[2]
+
+// cleanUpFile
+// truncate tegrastats.log in place, tegrastats keeps appending to the same file
+func (e *Tegrastats) cleanUpFile() {
+	if err := os.Truncate(e.LogFile, 0); err != nil {
+		log.Errorf("clean up %s: %s", e.LogFile, err)
+		return
 	}
-	return emcMap
+	log.Println("cleanUpFile end ......")
 }
-func GetVdd(text string) map[string]VddInfo {
-	var vddMap = make(map[string]VddInfo)
-	matchRegxp := regexp.MustCompile("VDD_([A-Za-z0-9_]*) ([0-9]*)\\/([0-9]*)")
-	params := matchRegxp.FindAllStringSubmatch(text, -1)
-	if params != nil {
-		for i, value := range params {
-			vddInfo := VddInfo{}
-			vddInfo.index = i
-			vddInfo.label = value[1]
-			val, _ := strconv.Atoi(value[2])
-			vddInfo.current = val
-			val, _ = strconv.Atoi(value[3])
-			vddInfo.average = val
-			vddMap[value[1]] = vddInfo
-		}
+
+// binary returns the path of the tegrastats binary, or "" when it is not installed
+func (e *Tegrastats) binary() string {
+	if e.Binary != "" {
+		return e.Binary
 	}
-	return vddMap
-}
-func GetTemp(text string) map[string]float64 {
-	var temp = make(map[string]float64)
-	matchRegxp := regexp.MustCompile("\\b(\\w+)@(-?[0-9.]+)C\\b")
-	params := matchRegxp.FindAllStringSubmatch(text, -1)
-	if params != nil {
-		for _, value := range params {
-			val, _ := strconv.ParseFloat(value[2], 64)
-			temp[value[1]] = val
+	var binPaths = []string{"/usr/bin/tegrastats", "/home/nvidia/tegrastats"}
+	for _, path := range binPaths {
+		_, err := os.Stat(e.Paths.root(path))
+		if err == nil {
+			return e.Paths.root(path)
 		}
 	}
-	return temp
+	if path, err := exec.LookPath("tegrastats"); err == nil {
+		return path
+	}
+	return ""
 }
-func GetMTS(text string) map[string]int {
-	var mtsMap = make(map[string]int)
-	matchRegxp := regexp.MustCompile("MTS fg (\\d+)% bg (\\d+)%")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		val, _ := strconv.Atoi(params[1])
-		mtsMap["fg"] = val
-		val, _ = strconv.Atoi(params[2])
-		mtsMap["bg"] = val
+
+// Available reports whether a tegrastats binary is installed
+func (e *Tegrastats) Available() bool {
+	if e.Binary != "" {
+		_, err := os.Stat(e.Binary)
+		return err == nil
 	}
-	return mtsMap
+	return e.binary() != ""
 }
-func GetGR3D(text string) map[string]int {
-	var gr3dMap = make(map[string]int)
-	matchRegxp := regexp.MustCompile("GR3D ([0-9]*)%@([0-9]*)?")
-	params := matchRegxp.FindStringSubmatch(text)
-	if params != nil {
-		val, _ := strconv.Atoi(params[1])
-		gr3dMap["use"] = val
-		val, _ = strconv.Atoi(params[2])
-		gr3dMap["freq"] = val
+
+func IsFile(path string) bool {
+	return !IsDir(path)
+}
+func IsDir(path string) bool {
+	s, err := os.Stat(path)
+	if err != nil {
+		return false
 	}
-	return gr3dMap
+	return s.IsDir()
 }
@@ -0,0 +1,192 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// backfillSource hands the line being backfilled to the collectors.
+type backfillSource struct {
+	sample *tegrastats.Sample
+}
+
+func (s *backfillSource) Start() error                       { return nil }
+func (s *backfillSource) Stop()                              {}
+func (s *backfillSource) Latest() *tegrastats.Sample         { return s.sample }
+func (s *backfillSource) Subscribe(func(*tegrastats.Sample)) {}
+
+// spill collects the samples of one metric family in a temporary file, because OpenMetrics
+// wants every family in one block while the log yields all families line by line.
+type spill struct {
+	header []byte
+	file   *os.File
+	w      *bufio.Writer
+}
+
+// Backfill writes the metrics of every line of a timestamped tegrastats log, or of a recording,
+// to w as OpenMetrics stamped with the time of the line, for
+//
+//	promtool tsdb create-blocks-from openmetrics <file> <dir>
+//
+// The series are the ones the exporter serves with opts and the named collectors.
+// Timestamps tegrastats printed are read in loc, the time zone of the device.
+// It returns how many lines were converted.
+func Backfill(r io.Reader, w io.Writer, opts CollectorOptions, names []string, loc *time.Location) (int, error) {
+	dir, err := os.MkdirTemp("", "jetson_exporter_backfill")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	source := &backfillSource{}
+	// the scaling governor is not in the log, so do not read the one of this machine
+	opts.Paths = Paths{Sysfs: dir, Procfs: dir, Rootfs: dir}
+	// every line is old, and exactly as old as its timestamp says
+	opts.StaleAfter = 0
+	opts.energy = newEnergyMeter(opts.Interval)
+	opts.stats = newStatsRecorder(opts.StatsWindow)
+	collector, err := NewCollector(source, opts, names)
+	if err != nil {
+		return 0, err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	spills := make(map[string]*spill)
+	var order []string
+	defer func() {
+		for _, s := range spills {
+			s.file.Close()
+		}
+	}()
+
+	var last time.Time
+	converted, untimed, repeated := 0, 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		at, line, recorded := ParseRecord(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sample, err := tegrastats.Parse(line)
+		if err != nil {
+			log.Debugf("parse tegrastats line: %s", err)
+		}
+		if sample.TimePresent {
+			t := sample.Time
+			at = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+		} else if !recorded {
+			untimed++
+			continue
+		} else {
+			sample.Time = at
+		}
+		// a series takes one value per millisecond and the printed time only has seconds
+		if !at.Truncate(time.Millisecond).After(last) {
+			repeated++
+			continue
+		}
+		last = at.Truncate(time.Millisecond)
+
+		source.sample = sample
+		opts.energy.observeAt(sample, at)
+		opts.stats.observeAt(sample, at)
+		opts.stats.now = func() time.Time { return at }
+		families, err := registry.Gather()
+		if err != nil {
+			return converted, err
+		}
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), namespace+"_scrape_") {
+				continue
+			}
+			s, ok := spills[family.GetName()]
+			if !ok {
+				if s, err = newSpill(dir, family); err != nil {
+					return converted, err
+				}
+				spills[family.GetName()] = s
+				order = append(order, family.GetName())
+			}
+			if err := s.write(family, at); err != nil {
+				return converted, err
+			}
+		}
+		converted++
+	}
+	if err := scanner.Err(); err != nil {
+		return converted, err
+	}
+	if untimed > 0 {
+		log.Warnf("skipped %d lines without a timestamp, tegrastats prints one since JetPack 4.6", untimed)
+	}
+	if repeated > 0 {
+		log.Warnf("skipped %d lines with the same timestamp as the line before", repeated)
+	}
+
+	for _, name := range order {
+		if err := spills[name].copyTo(w); err != nil {
+			return converted, err
+		}
+	}
+	_, err = expfmt.FinalizeOpenMetrics(w)
+	return converted, err
+}
+
+func newSpill(dir string, family *dto.MetricFamily) (*spill, error) {
+	var header bytes.Buffer
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&header, &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "family")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{header: header.Bytes(), file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// write appends the samples of family, stamped with at, without the family header.
+func (s *spill) write(family *dto.MetricFamily, at time.Time) error {
+	ms := at.UnixNano() / int64(time.Millisecond)
+	for _, m := range family.Metric {
+		m.TimestampMs = &ms
+	}
+	var buf bytes.Buffer
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, family); err != nil {
+		return err
+	}
+	for _, line := range bytes.SplitAfter(buf.Bytes(), []byte("\n")) {
+		if len(line) > 0 && line[0] != '#' {
+			if _, err := s.w.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *spill) copyTo(w io.Writer) error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(s.header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, s.file); err != nil {
+		return fmt.Errorf("copy %s: %s", s.file.Name(), err)
+	}
+	return nil
+}
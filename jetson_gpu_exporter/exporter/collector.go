@@ -0,0 +1,194 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// errNoData is returned by a collector when the sample has none of its fields,
+// e.g. the iram collector on boards without IRAM.
+var errNoData = errors.New("collector returned no data")
+
+// errStale marks the collectors skipped because the sample is older than StaleAfter.
+var errStale = errors.New("sample is stale")
+
+var (
+	scrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_duration_seconds"),
+		"Duration of a collector scrape.",
+		[]string{"collector"}, nil,
+	)
+	scrapeSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_success"),
+		"Whether a collector succeeded.",
+		[]string{"collector"}, nil,
+	)
+	lastSampleTimestampDesc = newDesc("last_sample_timestamp_seconds", "Unix time tegrastats printed in front of the last sample, or the time it was received when tegrastats printed none.")
+)
+
+// Factors converting the units tegrastats prints into base units.
+const (
+	percent    = 0.01
+	megahertz  = 1e6
+	milliwatts = 1e-3
+)
+
+// collector exports one group of a sample, e.g. RAM or the power rails.
+type collector interface {
+	// Update sends the metrics of sample to ch.
+	Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error
+}
+
+// CollectorOptions configure the collectors built by NewCollector.
+type CollectorOptions struct {
+	Paths Paths
+	// LegacyNames exports the original metric families, which multiplex values of
+	// different units through a statistic label, instead of the base-unit ones.
+	LegacyNames bool
+	// Interval is how often the source produces a sample.
+	Interval time.Duration
+	// StatsWindow is how far back the min/max/avg gauges of the sampled values look.
+	StatsWindow time.Duration
+	// StaleAfter, when positive, drops the hardware metrics of a sample older than this,
+	// so Prometheus marks them stale instead of plotting a frozen value.
+	StaleAfter time.Duration
+
+	// energy and stats are shared by every Collector built from these options.
+	energy *energyMeter
+	stats  *statsRecorder
+}
+
+// collectorFactory builds a collector; it returns nil when the collector has no families
+// under opts, e.g. the engine collector with LegacyNames.
+type collectorFactory func(opts CollectorOptions) collector
+
+var (
+	factories      = make(map[string]collectorFactory)
+	defaultEnabled = make(map[string]bool)
+)
+
+// registerCollector makes a collector available under name; collectors call it from init.
+func registerCollector(name string, isDefaultEnabled bool, factory collectorFactory) {
+	factories[name] = factory
+	defaultEnabled[name] = isDefaultEnabled
+}
+
+// CollectorNames returns the names of all registered collectors, sorted.
+func CollectorNames() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CollectorDefaultEnabled reports whether a collector runs unless it is disabled.
+func CollectorDefaultEnabled(name string) bool {
+	return defaultEnabled[name]
+}
+
+// Collector runs the enabled collectors over the latest sample of a source.
+// It keeps no state between scrapes: every Collect takes one immutable snapshot
+// and builds const metrics from it, so concurrent scrapes never block each other.
+type Collector struct {
+	source     Source
+	opts       CollectorOptions
+	collectors map[string]collector
+}
+
+// NewCollector returns a Collector running the named collectors over the samples of source.
+func NewCollector(source Source, opts CollectorOptions, names []string) (*Collector, error) {
+	if opts.energy == nil {
+		opts.energy = newEnergyMeter(opts.Interval)
+		source.Subscribe(opts.energy.observe)
+	}
+	if opts.stats == nil {
+		opts.stats = newStatsRecorder(opts.StatsWindow)
+		source.Subscribe(opts.stats.observe)
+	}
+	collectors := make(map[string]collector)
+	for _, name := range names {
+		factory, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("missing collector: %s", name)
+		}
+		collectors[name] = factory(opts)
+	}
+	return &Collector{source: source, opts: opts, collectors: collectors}, nil
+}
+
+// filter returns a new Collector running only the named collectors, which must all be enabled in c.
+func (c *Collector) filter(names []string) (*Collector, error) {
+	for _, name := range names {
+		if _, ok := factories[name]; !ok {
+			return nil, fmt.Errorf("missing collector: %s", name)
+		}
+		if _, ok := c.collectors[name]; !ok {
+			return nil, fmt.Errorf("disabled collector: %s", name)
+		}
+	}
+	return NewCollector(c.source, c.opts, names)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- scrapeDurationDesc
+	ch <- scrapeSuccessDesc
+	ch <- lastSampleTimestampDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	sample := c.source.Latest()
+	if sample == nil {
+		sample = &tegrastats.Sample{}
+	}
+	stale := false
+	if !sample.Time.IsZero() {
+		sendGauge(ch, lastSampleTimestampDesc, float64(sample.Time.UnixNano())/1e9)
+		if age := time.Since(sample.Time); c.opts.StaleAfter > 0 && age > c.opts.StaleAfter {
+			log.Debugf("last sample is %s old, dropping the hardware metrics", age.Round(time.Second))
+			stale = true
+		}
+	}
+	for name, col := range c.collectors {
+		if col == nil {
+			continue
+		}
+		begin := time.Now()
+		var err error
+		if stale {
+			err = errStale
+		} else {
+			err = col.Update(sample, ch)
+		}
+		duration := time.Since(begin)
+		success := 1
+		if err != nil {
+			success = 0
+			if err == errNoData || err == errStale {
+				log.Debugf("collector %s returned no data", name)
+			} else {
+				log.Errorf("collector %s failed after %fs: %s", name, duration.Seconds(), err)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, float64(success), name)
+	}
+}
+
+// newDesc returns the description of a metric in the exporter namespace.
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
+// sendGauge sends a gauge for desc with the given label values.
+func sendGauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+)
+
+func init() {
+	registerCollector("cpu", true, newCPUCollector)
+}
+
+var (
+	cpuOnlineDesc      = newDesc("cpu_online", "Whether a CPU core is online.", "cpu")
+	cpuUtilizationDesc = newDesc("cpu_utilization_ratio", "Load of an online CPU core, from 0 to 1.", "cpu")
+	cpuFrequencyDesc   = newDesc("cpu_frequency_hertz", "Clock of an online CPU core in hertz.", "cpu")
+	cpuGovernorDesc    = newDesc("cpu_scaling_governor_info", "cpufreq scaling governor of a CPU core, always 1.", "cpu", "governor")
+)
+
+type cpuCollector struct {
+	paths Paths
+}
+
+func newCPUCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyCPUCollector(opts.Paths)
+	}
+	return withStats(&cpuCollector{paths: opts.Paths}, opts.stats, opts.stats.cpu)
+}
+
+func (c *cpuCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.CPU.Present {
+		return errNoData
+	}
+	for _, core := range sample.CPU.Cores {
+		cpu := strconv.Itoa(core.Index)
+		if !core.Online {
+			sendGauge(ch, cpuOnlineDesc, 0, cpu)
+			continue
+		}
+		sendGauge(ch, cpuOnlineDesc, 1, cpu)
+		sendGauge(ch, cpuUtilizationDesc, core.LoadPercent*percent, cpu)
+		if core.FrequencyPresent {
+			sendGauge(ch, cpuFrequencyDesc, core.FrequencyMHz*megahertz, cpu)
+		}
+		if governor := readGovernor(c.paths, core.Index); governor != "" {
+			sendGauge(ch, cpuGovernorDesc, 1, cpu, governor)
+		}
+	}
+	return nil
+}
+
+// readGovernor returns the cpufreq scaling governor of a core, or "" when cpufreq is unavailable.
+func readGovernor(paths Paths, core int) string {
+	governor, err := readString(paths.sys(fmt.Sprintf("devices/system/cpu/cpu%d/cpufreq/scaling_governor", core)))
+	if err != nil {
+		return ""
+	}
+	return governor
+}
+
+func CpuFreqPowerString(cpuFreq string) (ans float64) {
+	/*
+		performance         运行于最大频率   ---- 1
+
+		powersave         运行于最小频率  ---- 2
+
+		userspace         运行于用户指定的频率  ---3
+
+		ondemand         按需快速动态调整CPU频率， 一有cpu计算量的任务，就会立即达到最大频率运行，空闲时间增加就降低频率 ---4
+
+		conservative         按需快速动态调整CPU频率， 比 ondemand 的调整更保守 ---5
+
+		schedutil         基于调度程序调整 CPU 频率   ---- 0
+
+		smartass    聪明模式，是I和C模式的升级，该模式在比i模式不差的响应的前提下会做到了更加省电 ---6
+		       流畅度： 最高，流畅
+
+		Hotplug    类似于ondemand, 但是cpu会在关屏下尝试关掉一个cpu，并且带有deep sleep，比较省电。  ---7
+		       流畅度：一般，流畅
+	*/
+	switch {
+	case cpuFreq == "schedutil":
+		return float64(0)
+	case cpuFreq == "performance":
+		return float64(1)
+	case cpuFreq == "powersave":
+		return float64(2)
+	case cpuFreq == "userspace":
+		return float64(3)
+	case cpuFreq == "ondemand":
+		return float64(4)
+	case cpuFreq == "conservative":
+		return float64(5)
+	case cpuFreq == "smartass":
+		return float64(6)
+	case cpuFreq == "Hotplug":
+		return float64(7)
+	}
+	return
+}
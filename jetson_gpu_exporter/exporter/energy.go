@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+// maxEnergyGapIntervals is how many sampling intervals may pass between two samples before
+// the gap is treated as an outage, e.g. a tegrastats restart, rather than integrated.
+const maxEnergyGapIntervals = 5
+
+var railEnergyDesc = newDesc("rail_energy_joules_total", "Energy drawn through a rail in joules, integrated from every sample since the exporter started.", "rail")
+
+// energyMeter integrates the power of every rail over every sample of a source.
+// It lives as long as the exporter, so the counters keep growing across tegrastats restarts.
+type energyMeter struct {
+	interval time.Duration
+	// last is only touched by observe, which runs on the goroutine reading the source.
+	last time.Time
+	// joules holds an immutable map[string]float64 that observe replaces after every sample.
+	joules atomic.Value
+}
+
+func newEnergyMeter(interval time.Duration) *energyMeter {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	m := &energyMeter{interval: interval}
+	m.joules.Store(map[string]float64{})
+	return m
+}
+
+func (m *energyMeter) observe(sample *tegrastats.Sample) {
+	m.observeAt(sample, measuredAt(sample))
+}
+
+// measuredAt returns when the values of a sample were measured: the time tegrastats printed,
+// the time a replayed sample was recorded, or else the time the source received it.
+// Integrating over it keeps the energy right for lines that arrive in bursts and for replays faster than real time.
+func measuredAt(sample *tegrastats.Sample) time.Time {
+	switch {
+	case sample.TimePresent:
+		return sample.Time
+	case !sample.Recorded.IsZero():
+		return sample.Recorded
+	case !sample.Time.IsZero():
+		return sample.Time
+	}
+	return time.Now()
+}
+
+// observeAt adds the energy each rail drew since the previous sample at the power of this one.
+// After an outage only one sampling interval is counted, as the power during it is unknown.
+func (m *energyMeter) observeAt(sample *tegrastats.Sample, at time.Time) {
+	last := m.last
+	if !last.IsZero() && !at.After(last) {
+		// tegrastats prints whole seconds, so with a sub-second interval several samples
+		// share a timestamp: they are taken one interval apart instead
+		at = last.Add(m.interval)
+	}
+	m.last = at
+	if last.IsZero() || len(sample.Rails) == 0 {
+		return
+	}
+	elapsed := at.Sub(last)
+	if elapsed > maxEnergyGapIntervals*m.interval {
+		elapsed = m.interval
+	}
+	old := m.joules.Load().(map[string]float64)
+	joules := make(map[string]float64, len(old)+len(sample.Rails))
+	for name, value := range old {
+		joules[name] = value
+	}
+	for name, rail := range sample.Rails {
+		joules[name] += rail.CurrentMilliwatts * milliwatts * elapsed.Seconds()
+	}
+	m.joules.Store(joules)
+}
+
+// collect sends a counter for every rail seen so far.
+func (m *energyMeter) collect(ch chan<- prometheus.Metric) {
+	for name, value := range m.joules.Load().(map[string]float64) {
+		ch <- prometheus.MustNewConstMetric(railEnergyDesc, prometheus.CounterValue, value, name)
+	}
+}
@@ -0,0 +1,61 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+func init() {
+	registerCollector("engine", true, newEngineCollector)
+}
+
+var (
+	engineOnlineDesc      = newDesc("engine_online", "Whether a hardware engine (GPU, EMC, NVENC, NVDEC, NVJPG, VIC, APE, DLA, PVA) is powered on.", "engine")
+	engineUtilizationDesc = newDesc("engine_utilization_ratio", "Load of a hardware engine, from 0 to 1.", "engine")
+	engineFrequencyDesc   = newDesc("engine_frequency_hertz", "Clock of a hardware engine in hertz.", "engine")
+)
+
+type engineCollector struct{}
+
+// newEngineCollector returns nil with LegacyNames, the first releases had no engine family.
+func newEngineCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return nil
+	}
+	return &engineCollector{}
+}
+
+func (c *engineCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if len(sample.Engines) == 0 {
+		return errNoData
+	}
+	for name, engine := range engines(sample) {
+		if !engine.Online {
+			sendGauge(ch, engineOnlineDesc, 0, name)
+			continue
+		}
+		sendGauge(ch, engineOnlineDesc, 1, name)
+		if engine.UtilizationPresent {
+			sendGauge(ch, engineUtilizationDesc, engine.UtilizationPercent*percent, name)
+		}
+		if engine.FrequencyPresent {
+			sendGauge(ch, engineFrequencyDesc, engine.FrequencyMHz*megahertz, name)
+		}
+	}
+	return nil
+}
+
+// engines returns the engines of sample keyed by name without the _FREQ suffix.
+// Where tegrastats printed both NAME and NAME_FREQ, NAME_FREQ wins.
+func engines(sample *tegrastats.Sample) map[string]tegrastats.Engine {
+	engines := make(map[string]tegrastats.Engine, len(sample.Engines))
+	for name, engine := range sample.Engines {
+		label := strings.TrimSuffix(name, "_FREQ")
+		if _, ok := engines[label]; ok && label == name {
+			continue
+		}
+		engines[label] = engine
+	}
+	return engines
+}
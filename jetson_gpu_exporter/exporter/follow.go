@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// followChunk is how much of the end of a logfile is read to find its last line when following starts.
+const followChunk = 64 << 10
+
+// follower passes every line appended to a logfile to line, like tail -F.
+// It starts over when the file is truncated, as the logfile cleanup job does, or replaced.
+type follower struct {
+	path     string
+	interval time.Duration
+	line     func(string)
+
+	file   *os.File
+	offset int64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newFollower(path string, interval time.Duration, line func(string)) *follower {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &follower{path: path, interval: interval, line: line}
+}
+
+// start passes the last complete line already in the file, if any, and follows the file in the background.
+func (f *follower) start() {
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	if f.open() {
+		f.seekLastLine()
+	}
+	go func() {
+		defer close(f.done)
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for {
+			f.poll()
+			select {
+			case <-ticker.C:
+			case <-f.stop:
+				if f.file != nil {
+					f.file.Close()
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (f *follower) stopFollowing() {
+	if f.stop == nil {
+		return
+	}
+	close(f.stop)
+	<-f.done
+}
+
+func (f *follower) open() bool {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false
+	}
+	f.file = file
+	f.offset = 0
+	return true
+}
+
+// seekLastLine passes the last complete line of the file and moves the offset behind it.
+func (f *follower) seekLastLine() {
+	info, err := f.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	from := info.Size() - followChunk
+	if from < 0 {
+		from = 0
+	}
+	buf := make([]byte, info.Size()-from)
+	n, _ := f.file.ReadAt(buf, from)
+	buf = buf[:n]
+	end := bytes.LastIndexByte(buf, '\n')
+	if end < 0 {
+		return
+	}
+	f.offset = from + int64(end) + 1
+	start := bytes.LastIndexByte(buf[:end], '\n') + 1
+	f.emit(buf[start:end])
+}
+
+// poll passes the complete lines appended since the last poll.
+func (f *follower) poll() {
+	if f.file == nil && !f.open() {
+		return
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return
+	}
+	if current, err := os.Stat(f.path); err == nil && !os.SameFile(info, current) {
+		// replaced, read the new file from its beginning
+		f.file.Close()
+		if !f.open() {
+			f.file = nil
+			return
+		}
+		info, err = f.file.Stat()
+		if err != nil {
+			return
+		}
+	}
+	if info.Size() < f.offset {
+		f.offset = 0
+	}
+	if info.Size() == f.offset {
+		return
+	}
+	buf := make([]byte, info.Size()-f.offset)
+	n, err := f.file.ReadAt(buf, f.offset)
+	if err != nil && err != io.EOF {
+		return
+	}
+	buf = buf[:n]
+	for {
+		end := bytes.IndexByte(buf, '\n')
+		if end < 0 {
+			return
+		}
+		f.emit(buf[:end])
+		f.offset += int64(end) + 1
+		buf = buf[end+1:]
+	}
+}
+
+func (f *follower) emit(line []byte) {
+	// a writer that did not open the file with O_APPEND leaves a hole of NULs after truncation
+	line = bytes.Trim(line, "\x00\r")
+	if len(line) > 0 {
+		f.line(string(line))
+	}
+}
@@ -0,0 +1,90 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+)
+
+func init() {
+	registerCollector("gpu", true, newGPUCollector)
+	registerCollector("emc", true, newEMCCollector)
+	registerCollector("mts", true, newMTSCollector)
+}
+
+var (
+	gpuUtilizationDesc  = newDesc("gpu_utilization_ratio", "GPU (GR3D) load, from 0 to 1.")
+	gpuFrequencyDesc    = newDesc("gpu_frequency_hertz", "GPU (GR3D) clock in hertz, the highest GPC clock on boards that print one per GPC.")
+	gpuGPCFrequencyDesc = newDesc("gpu_gpc_frequency_hertz", "Clock of a GPU graphics processing cluster in hertz.", "gpc")
+	emcUtilizationDesc  = newDesc("emc_utilization_ratio", "External memory controller load, from 0 to 1.")
+	emcFrequencyDesc    = newDesc("emc_frequency_hertz", "External memory controller clock in hertz.")
+	mtsForegroundDesc   = newDesc("mts_foreground_ratio", "Share of CPU time spent on foreground tasks, from 0 to 1.")
+	mtsBackgroundDesc   = newDesc("mts_background_ratio", "Share of CPU time spent on background tasks, from 0 to 1.")
+)
+
+type gpuCollector struct{}
+
+func newGPUCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyGPUCollector()
+	}
+	return withStats(&gpuCollector{}, opts.stats, opts.stats.gpu)
+}
+
+func (c *gpuCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	gpu, ok := engines(sample)["GR3D"]
+	if !ok {
+		return errNoData
+	}
+	if gpu.UtilizationPresent {
+		sendGauge(ch, gpuUtilizationDesc, gpu.UtilizationPercent*percent)
+	}
+	if gpu.FrequencyPresent {
+		sendGauge(ch, gpuFrequencyDesc, gpu.FrequencyMHz*megahertz)
+	}
+	for i, freq := range gpu.GPCFrequenciesMHz {
+		sendGauge(ch, gpuGPCFrequencyDesc, freq*megahertz, strconv.Itoa(i))
+	}
+	return nil
+}
+
+type emcCollector struct{}
+
+func newEMCCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyEMCCollector()
+	}
+	return &emcCollector{}
+}
+
+func (c *emcCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	emc, ok := sample.Engines["EMC_FREQ"]
+	if !ok {
+		return errNoData
+	}
+	if emc.UtilizationPresent {
+		sendGauge(ch, emcUtilizationDesc, emc.UtilizationPercent*percent)
+	}
+	if emc.FrequencyPresent {
+		sendGauge(ch, emcFrequencyDesc, emc.FrequencyMHz*megahertz)
+	}
+	return nil
+}
+
+type mtsCollector struct{}
+
+func newMTSCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyMTSCollector()
+	}
+	return &mtsCollector{}
+}
+
+func (c *mtsCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.MTS.Present {
+		return errNoData
+	}
+	sendGauge(ch, mtsForegroundDesc, sample.MTS.ForegroundPercent*percent)
+	sendGauge(ch, mtsBackgroundDesc, sample.MTS.BackgroundPercent*percent)
+	return nil
+}
@@ -0,0 +1,441 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InfluxOptions configure the writing of every parsed sample to an InfluxDB v2 bucket.
+type InfluxOptions struct {
+	// URL is the InfluxDB server, e.g. http://influxdb:8086; the samples go to its /api/v2/write.
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	// Tags are added to every point. host is the hostname unless Tags has its own;
+	// memory, core, engine, rail and zone are taken by the points.
+	Tags map[string]string
+	// FlushInterval is how often the buffered samples are written.
+	FlushInterval time.Duration
+	// Timeout bounds one write request.
+	Timeout time.Duration
+	// MaxBufferedSamples bounds the samples kept while InfluxDB is unreachable; the oldest are dropped beyond it.
+	MaxBufferedSamples int
+}
+
+// Influx writes every sample of a source to InfluxDB as line protocol, at the resolution
+// tegrastats produces them rather than once per scrape. Samples are buffered and written
+// every FlushInterval; a write failing with a network error, 429 or 5xx is retried with the next one.
+type Influx struct {
+	opts   InfluxOptions
+	url    string
+	tags   string
+	source Source
+	client *http.Client
+
+	mu      sync.Mutex
+	pending [][]byte
+
+	written uint64
+	dropped uint64
+	failed  uint64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+var (
+	influxWrittenDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "influx", "samples_written_total"),
+		"Samples written to InfluxDB.",
+		nil, nil,
+	)
+	influxDroppedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "influx", "dropped_samples_total"),
+		"Samples dropped because InfluxDB rejected them or the buffer was full.",
+		nil, nil,
+	)
+	influxFailedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "influx", "write_failures_total"),
+		"Write requests InfluxDB did not accept.",
+		nil, nil,
+	)
+	influxBufferedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "influx", "buffered_samples"),
+		"Samples waiting to be written to InfluxDB.",
+		nil, nil,
+	)
+)
+
+// NewInflux returns a writer of the samples of source to InfluxDB as configured by opts.
+func NewInflux(opts InfluxOptions, source Source) (*Influx, error) {
+	tags, err := influxTags(opts.Tags)
+	if err != nil {
+		return nil, err
+	}
+	return newInflux(opts, tags, source)
+}
+
+// newInflux is NewInflux with the tag set already built by influxTags.
+func newInflux(opts InfluxOptions, tags string, source Source) (*Influx, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("influx url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("influx url %q: want http or https", opts.URL)
+	}
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("influx: no bucket")
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxBufferedSamples <= 0 {
+		opts.MaxBufferedSamples = 10000
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{"org": {opts.Org}, "bucket": {opts.Bucket}, "precision": {"ns"}}.Encode()
+	return &Influx{
+		opts:   opts,
+		url:    u.String(),
+		tags:   tags,
+		source: source,
+		client: &http.Client{Timeout: opts.Timeout},
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// influxPointTags are the tags telling the points of one measurement apart.
+var influxPointTags = []string{"memory", "core", "engine", "rail", "zone"}
+
+// influxTags returns the escaped ",name=value" tag set added to every point, sorted by name.
+func influxTags(tags map[string]string) (string, error) {
+	for _, name := range influxPointTags {
+		if _, ok := tags[name]; ok {
+			return "", fmt.Errorf("influx tag %q is taken by the points, pick another name", name)
+		}
+	}
+	all := map[string]string{}
+	if _, ok := tags["host"]; !ok {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		all["host"] = hostname
+	}
+	for name, value := range tags {
+		all[name] = value
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		if all[name] == "" {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(influxEscaper.Replace(name))
+		b.WriteString("=")
+		b.WriteString(influxEscaper.Replace(all[name]))
+	}
+	return b.String(), nil
+}
+
+// Start buffers every sample of the source from now on and writes them in the background until Stop.
+func (i *Influx) Start() {
+	log.Printf("Writing samples to InfluxDB bucket %s at %s every %s", i.opts.Bucket, i.opts.URL, i.opts.FlushInterval)
+	i.source.Subscribe(i.enqueue)
+	i.done = make(chan struct{})
+	go func() {
+		defer close(i.done)
+		ticker := time.NewTicker(i.opts.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := i.Flush(context.Background()); err != nil {
+					log.Errorf("influx: %s", err)
+				}
+			case <-i.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop writes the buffered samples one last time and stops.
+func (i *Influx) Stop() {
+	i.once.Do(func() {
+		close(i.stop)
+		if i.done != nil {
+			<-i.done
+		}
+		if err := i.Flush(context.Background()); err != nil {
+			log.Errorf("influx: %s", err)
+		}
+	})
+}
+
+func (i *Influx) enqueue(sample *tegrastats.Sample) {
+	select {
+	case <-i.stop:
+		return
+	default:
+	}
+	lines := appendLineProtocol(nil, sample, i.tags)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pending = append(i.pending, lines)
+	if n := len(i.pending) - i.opts.MaxBufferedSamples; n > 0 {
+		i.pending = i.pending[n:]
+		atomic.AddUint64(&i.dropped, uint64(n))
+	}
+}
+
+func (i *Influx) buffered() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.pending)
+}
+
+// Flush writes the buffered samples in one request. Samples failing with an error worth retrying
+// stay buffered for the next Flush, the others are dropped.
+func (i *Influx) Flush(ctx context.Context) error {
+	i.mu.Lock()
+	samples := i.pending
+	i.pending = nil
+	i.mu.Unlock()
+	if len(samples) == 0 {
+		return nil
+	}
+	retry, err := i.write(ctx, bytes.Join(samples, nil))
+	if err == nil {
+		atomic.AddUint64(&i.written, uint64(len(samples)))
+		return nil
+	}
+	atomic.AddUint64(&i.failed, 1)
+	if !retry {
+		atomic.AddUint64(&i.dropped, uint64(len(samples)))
+		return fmt.Errorf("dropped %d samples: %s", len(samples), err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pending = append(samples, i.pending...)
+	if n := len(i.pending) - i.opts.MaxBufferedSamples; n > 0 {
+		i.pending = i.pending[n:]
+		atomic.AddUint64(&i.dropped, uint64(n))
+	}
+	return fmt.Errorf("%s, keeping %d samples for the next write", err, len(i.pending))
+}
+
+// write posts line protocol and reports whether a failure is worth retrying.
+func (i *Influx) write(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "jetson_exporter")
+	if i.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.opts.Token)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// Describe implements prometheus.Collector for the InfluxDB self-metrics
+func (i *Influx) Describe(ch chan<- *prometheus.Desc) {
+	ch <- influxWrittenDesc
+	ch <- influxDroppedDesc
+	ch <- influxFailedDesc
+	ch <- influxBufferedDesc
+}
+
+// Collect implements prometheus.Collector for the InfluxDB self-metrics
+func (i *Influx) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(influxWrittenDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&i.written)))
+	ch <- prometheus.MustNewConstMetric(influxDroppedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&i.dropped)))
+	ch <- prometheus.MustNewConstMetric(influxFailedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&i.failed)))
+	ch <- prometheus.MustNewConstMetric(influxBufferedDesc, prometheus.GaugeValue, float64(i.buffered()))
+}
+
+// influxEscaper escapes measurement names, tag keys, tag values and field keys.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// appendLineProtocol appends a sample as InfluxDB line protocol, one point per group or
+// per core, engine, rail and zone, all at the sample time in nanoseconds:
+//
+//	jetson_memory,memory=ram,host=nx01 used_bytes=1811939328i,total_bytes=8140095488i,... 1700000000000000000
+//	jetson_cpu,core=0,host=nx01 online=true,load_percent=12,frequency_mhz=1479 ...
+//	jetson_engine,engine=GR3D_FREQ,host=nx01 online=true,utilization_percent=34,frequency_mhz=1109 ...
+//	jetson_rail,rail=VDD_IN,host=nx01 current_mw=4950,average_mw=4950 ...
+//	jetson_thermal,zone=GPU,host=nx01 celsius=38.5 ...
+//
+// The field names are those of the parse command's columns without the group prefix.
+// tags are the escaped tags added to every point, as influxTags returns them.
+func appendLineProtocol(buf []byte, sample *tegrastats.Sample, tags string) []byte {
+	ts := strconv.FormatInt(sample.Time.UnixNano(), 10)
+	point := func(measurement, tag, value string, fields func(f *influxFields)) {
+		buf = append(buf, measurement...)
+		if tag != "" {
+			buf = append(buf, ',')
+			buf = append(buf, tag...)
+			buf = append(buf, '=')
+			buf = append(buf, influxEscaper.Replace(value)...)
+		}
+		buf = append(buf, tags...)
+		f := &influxFields{buf: append(buf, ' ')}
+		fields(f)
+		buf = append(f.buf, ' ')
+		buf = append(buf, ts...)
+		buf = append(buf, '\n')
+	}
+
+	memory := func(name string, m tegrastats.Memory, cached, lfb, blocks bool) {
+		if !m.Present {
+			return
+		}
+		point("jetson_memory", "memory", name, func(f *influxFields) {
+			f.uint("used_bytes", m.UsedBytes)
+			f.uint("total_bytes", m.TotalBytes)
+			if cached {
+				f.uint("cached_bytes", m.CachedBytes)
+			}
+			if lfb {
+				f.uint("lfb_bytes", m.LargestFreeBlockBytes)
+			}
+			if blocks {
+				f.uint("lfb_blocks", m.LargestFreeBlocks)
+			}
+		})
+	}
+	memory("ram", sample.RAM, false, true, true)
+	memory("swap", sample.Swap, true, false, false)
+	memory("iram", sample.IRAM, false, true, false)
+
+	for _, core := range sample.CPU.Cores {
+		point("jetson_cpu", "core", strconv.Itoa(core.Index), func(f *influxFields) {
+			f.bool("online", core.Online)
+			if core.Online {
+				f.float("load_percent", core.LoadPercent)
+			}
+			if core.FrequencyPresent {
+				f.float("frequency_mhz", core.FrequencyMHz)
+			}
+		})
+	}
+	if sample.MTS.Present {
+		point("jetson_mts", "", "", func(f *influxFields) {
+			f.float("fg_percent", sample.MTS.ForegroundPercent)
+			f.float("bg_percent", sample.MTS.BackgroundPercent)
+		})
+	}
+
+	var names []string
+	for name := range sample.Engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		engine := sample.Engines[name]
+		point("jetson_engine", "engine", name, func(f *influxFields) {
+			f.bool("online", engine.Online)
+			if engine.UtilizationPresent {
+				f.float("utilization_percent", engine.UtilizationPercent)
+			}
+			if engine.FrequencyPresent {
+				f.float("frequency_mhz", engine.FrequencyMHz)
+			}
+			for i, freq := range engine.GPCFrequenciesMHz {
+				f.float("gpc"+strconv.Itoa(i)+"_frequency_mhz", freq)
+			}
+		})
+	}
+	names = names[:0]
+	for name := range sample.Rails {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rail := sample.Rails[name]
+		point("jetson_rail", "rail", name, func(f *influxFields) {
+			f.float("current_mw", rail.CurrentMilliwatts)
+			f.float("average_mw", rail.AverageMilliwatts)
+		})
+	}
+	names = names[:0]
+	for name := range sample.Temps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		temp := sample.Temps[name]
+		point("jetson_thermal", "zone", name, func(f *influxFields) {
+			f.float("celsius", temp.Celsius)
+		})
+	}
+	return buf
+}
+
+// influxFields appends the comma separated fields of one point.
+type influxFields struct {
+	buf []byte
+	n   int
+}
+
+func (f *influxFields) key(name string) {
+	if f.n > 0 {
+		f.buf = append(f.buf, ',')
+	}
+	f.n++
+	f.buf = append(f.buf, influxEscaper.Replace(name)...)
+	f.buf = append(f.buf, '=')
+}
+
+func (f *influxFields) float(name string, v float64) {
+	f.key(name)
+	f.buf = strconv.AppendFloat(f.buf, v, 'f', -1, 64)
+}
+
+func (f *influxFields) uint(name string, v uint64) {
+	f.key(name)
+	f.buf = strconv.AppendUint(f.buf, v, 10)
+	f.buf = append(f.buf, 'i')
+}
+
+func (f *influxFields) bool(name string, v bool) {
+	f.key(name)
+	f.buf = strconv.AppendBool(f.buf, v)
+}
@@ -0,0 +1,216 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+// The legacy collectors export the metric families of the first releases, selected with
+// --metrics.legacy-names: one family per tegrastats group whose statistic label mixes
+// values in MB, kB, MHz, mW and percent. They are kept until dashboards have migrated,
+// so they export the families and label sets of those releases and nothing newer:
+// no energy counters and no min/max/avg gauges.
+
+type legacyRAMCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyRAMCollector() collector {
+	return &legacyRAMCollector{desc: newDesc("ram", "ram statistics from tegrastats", "statistic")}
+}
+
+func (c *legacyRAMCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.RAM.Present {
+		return errNoData
+	}
+	sendGauge(ch, c.desc, toMegabytes(sample.RAM.UsedBytes), "used")
+	sendGauge(ch, c.desc, toMegabytes(sample.RAM.TotalBytes), "tot")
+	sendGauge(ch, c.desc, toMegabytes(sample.RAM.LargestFreeBlockBytes), "lfb_size")
+	sendGauge(ch, c.desc, float64(sample.RAM.LargestFreeBlocks), "lfb_noblock")
+	return nil
+}
+
+type legacySwapCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacySwapCollector() collector {
+	return &legacySwapCollector{desc: newDesc("swap", "swap statistics from tegrastats", "statistic")}
+}
+
+func (c *legacySwapCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.Swap.Present {
+		return errNoData
+	}
+	sendGauge(ch, c.desc, toMegabytes(sample.Swap.UsedBytes), "used")
+	sendGauge(ch, c.desc, toMegabytes(sample.Swap.TotalBytes), "tot")
+	sendGauge(ch, c.desc, toMegabytes(sample.Swap.CachedBytes), "cached")
+	return nil
+}
+
+type legacyIRAMCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyIRAMCollector() collector {
+	return &legacyIRAMCollector{desc: newDesc("iram", "iram statistics from tegrastats", "statistic")}
+}
+
+func (c *legacyIRAMCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.IRAM.Present {
+		return errNoData
+	}
+	sendGauge(ch, c.desc, toKilobytes(sample.IRAM.UsedBytes), "used")
+	sendGauge(ch, c.desc, toKilobytes(sample.IRAM.TotalBytes), "tot")
+	sendGauge(ch, c.desc, toKilobytes(sample.IRAM.LargestFreeBlockBytes), "lfb")
+	return nil
+}
+
+type legacyCPUCollector struct {
+	paths Paths
+	desc  *prometheus.Desc
+}
+
+func newLegacyCPUCollector(paths Paths) collector {
+	return &legacyCPUCollector{
+		paths: paths,
+		desc:  newDesc("cpu", "cpu statistics from tegrastats", "number", "statistic"),
+	}
+}
+
+func (c *legacyCPUCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.CPU.Present {
+		return errNoData
+	}
+	for _, core := range sample.CPU.Cores {
+		key := strconv.Itoa(core.Index)
+		status := 0
+		if core.Online {
+			status = 1
+		}
+		sendGauge(ch, c.desc, float64(status), key, "status")
+		sendGauge(ch, c.desc, core.LoadPercent, key, "load")
+		sendGauge(ch, c.desc, core.FrequencyMHz, key, "Frequency (MHz)")
+		sendGauge(ch, c.desc, CpuFreqPowerString(readGovernor(c.paths, core.Index)), key, "governor")
+	}
+	return nil
+}
+
+type legacyGPUCollector struct {
+	gr3dFreqDesc *prometheus.Desc
+	gr3dDesc     *prometheus.Desc
+}
+
+func newLegacyGPUCollector() collector {
+	return &legacyGPUCollector{
+		gr3dFreqDesc: newDesc("grd3_freq", "grd3_freq statistics from tegrastats", "statistic"),
+		gr3dDesc:     newDesc("gr3d", "gr3d statistics from tegrastats", "statistic"),
+	}
+}
+
+func (c *legacyGPUCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	gr3dFreq, hasFreq := sample.Engines["GR3D_FREQ"]
+	gr3d, hasGR3D := sample.Engines["GR3D"]
+	if !hasFreq && !hasGR3D {
+		return errNoData
+	}
+	if hasFreq {
+		sendGauge(ch, c.gr3dFreqDesc, gr3dFreq.UtilizationPercent, "utilization_percentage")
+		sendGauge(ch, c.gr3dFreqDesc, gr3dFreq.FrequencyMHz, "frequency")
+	}
+	if hasGR3D {
+		sendGauge(ch, c.gr3dDesc, gr3d.UtilizationPercent, "use")
+		sendGauge(ch, c.gr3dDesc, gr3d.FrequencyMHz, "freq")
+	}
+	return nil
+}
+
+type legacyEMCCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyEMCCollector() collector {
+	return &legacyEMCCollector{desc: newDesc("emc_freq", "emc_freq statistics from tegrastats", "statistic")}
+}
+
+func (c *legacyEMCCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	emc, ok := sample.Engines["EMC_FREQ"]
+	if !ok {
+		return errNoData
+	}
+	sendGauge(ch, c.desc, emc.UtilizationPercent, "utilization_percentage")
+	sendGauge(ch, c.desc, emc.FrequencyMHz, "frequency")
+	return nil
+}
+
+type legacyMTSCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyMTSCollector() collector {
+	return &legacyMTSCollector{desc: newDesc("mts", "mts statistics from tegrastats", "statistic")}
+}
+
+func (c *legacyMTSCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if !sample.MTS.Present {
+		return errNoData
+	}
+	sendGauge(ch, c.desc, sample.MTS.ForegroundPercent, "fg")
+	sendGauge(ch, c.desc, sample.MTS.BackgroundPercent, "bg")
+	return nil
+}
+
+type legacyPowerCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyPowerCollector() collector {
+	return &legacyPowerCollector{desc: newDesc("vdd", "vdd statistics from tegrastats", "label", "statistic")}
+}
+
+// Update exports the VDD_ rails only, labelled without the prefix, as GetVdd matched them;
+// rails such as POM_5V_IN or VIN_SYS_5V0 never had a legacy series.
+func (c *legacyPowerCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	found := false
+	for name, rail := range sample.Rails {
+		if !strings.HasPrefix(name, "VDD_") {
+			continue
+		}
+		label := strings.TrimPrefix(name, "VDD_")
+		sendGauge(ch, c.desc, rail.CurrentMilliwatts, label, "current")
+		sendGauge(ch, c.desc, rail.AverageMilliwatts, label, "average")
+		found = true
+	}
+	if !found {
+		return errNoData
+	}
+	return nil
+}
+
+type legacyThermalCollector struct {
+	desc *prometheus.Desc
+}
+
+func newLegacyThermalCollector() collector {
+	return &legacyThermalCollector{desc: newDesc("temp", "temp statistics from tegrastats", "statistic")}
+}
+
+func (c *legacyThermalCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if len(sample.Temps) == 0 {
+		return errNoData
+	}
+	for name, temp := range sample.Temps {
+		sendGauge(ch, c.desc, temp.Celsius, name)
+	}
+	return nil
+}
+
+func toMegabytes(bytes uint64) float64 {
+	return float64(bytes) / (1 << 20)
+}
+
+func toKilobytes(bytes uint64) float64 {
+	return float64(bytes) / (1 << 10)
+}
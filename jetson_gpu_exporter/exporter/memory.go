@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("ram", true, newRAMCollector)
+	registerCollector("swap", true, newSwapCollector)
+	registerCollector("iram", true, newIRAMCollector)
+}
+
+// The ram, swap and iram collectors share these families and tell themselves apart by the memory label.
+var (
+	memoryUsedDesc              = newDesc("memory_used_bytes", "Used memory in bytes.", "memory")
+	memoryTotalDesc             = newDesc("memory_total_bytes", "Total memory in bytes.", "memory")
+	memoryCachedDesc            = newDesc("memory_cached_bytes", "Cached swap in bytes.", "memory")
+	memoryLargestFreeBlockDesc  = newDesc("memory_largest_free_block_bytes", "Size of the largest free block in bytes.", "memory")
+	memoryLargestFreeBlocksDesc = newDesc("memory_largest_free_blocks", "Number of free blocks of the largest free block size.", "memory")
+)
+
+type memoryCollector struct {
+	name   string
+	memory func(sample *tegrastats.Sample) tegrastats.Memory
+}
+
+func newRAMCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyRAMCollector()
+	}
+	return &memoryCollector{name: "ram", memory: func(sample *tegrastats.Sample) tegrastats.Memory { return sample.RAM }}
+}
+
+func newSwapCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacySwapCollector()
+	}
+	return &memoryCollector{name: "swap", memory: func(sample *tegrastats.Sample) tegrastats.Memory { return sample.Swap }}
+}
+
+func newIRAMCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyIRAMCollector()
+	}
+	return &memoryCollector{name: "iram", memory: func(sample *tegrastats.Sample) tegrastats.Memory { return sample.IRAM }}
+}
+
+func (c *memoryCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	m := c.memory(sample)
+	if !m.Present {
+		return errNoData
+	}
+	sendGauge(ch, memoryUsedDesc, float64(m.UsedBytes), c.name)
+	sendGauge(ch, memoryTotalDesc, float64(m.TotalBytes), c.name)
+	switch c.name {
+	case "swap":
+		sendGauge(ch, memoryCachedDesc, float64(m.CachedBytes), c.name)
+	case "ram":
+		sendGauge(ch, memoryLargestFreeBlockDesc, float64(m.LargestFreeBlockBytes), c.name)
+		sendGauge(ch, memoryLargestFreeBlocksDesc, float64(m.LargestFreeBlocks), c.name)
+	case "iram":
+		sendGauge(ch, memoryLargestFreeBlockDesc, float64(m.LargestFreeBlockBytes), c.name)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+	// mqttPublishTimeout bounds how long a publish may wait for the broker before it counts as failed.
+	mqttPublishTimeout = 10 * time.Second
+)
+
+// MQTTOptions configure the publishing of every parsed sample to an MQTT broker.
+type MQTTOptions struct {
+	// Broker is the broker URL, e.g. tcp://gateway:1883, ssl://gateway:8883 or ws://gateway:9001/mqtt.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Topic is where the samples go; {hostname} is replaced by Hostname. A topic with {metric}, e.g.
+	// jetson/{hostname}/{metric}, gets one message per value named like the columns of the parse
+	// command (gr3d_freq_utilization_percent), otherwise every sample is one JSON object.
+	Topic string
+	// StatusTopic holds a retained "online" while connected and "offline", the last will, otherwise.
+	StatusTopic string
+	QoS         byte
+	// Retain keeps the last sample on the broker for clients subscribing later.
+	Retain   bool
+	Hostname string
+	// CACert verifies the broker, ClientCert and ClientKey authenticate the exporter; all PEM files.
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+// MQTT publishes the samples of a source to an MQTT broker. Publishing never blocks the source:
+// a sample arriving while the previous one is still being published is skipped.
+type MQTT struct {
+	opts    MQTTOptions
+	source  Source
+	client  mqtt.Client
+	samples chan *tegrastats.Sample
+
+	published uint64
+	failed    uint64
+	skipped   uint64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+var (
+	mqttConnectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "mqtt", "connected"),
+		"Whether the exporter is connected to the MQTT broker.",
+		nil, nil,
+	)
+	mqttPublishedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "mqtt", "messages_published_total"),
+		"Messages published to the MQTT broker.",
+		nil, nil,
+	)
+	mqttFailedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "mqtt", "publish_failures_total"),
+		"Messages that could not be published, e.g. while the broker was unreachable.",
+		nil, nil,
+	)
+	mqttSkippedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "mqtt", "skipped_samples_total"),
+		"Samples skipped because the previous one was still being published.",
+		nil, nil,
+	)
+)
+
+// NewMQTT returns an MQTT publisher for the samples of source.
+func NewMQTT(opts MQTTOptions, source Source) (*MQTT, error) {
+	if opts.QoS > 2 {
+		return nil, fmt.Errorf("mqtt qos %d: want 0, 1 or 2", opts.QoS)
+	}
+	if opts.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		opts.Hostname = hostname
+	}
+	if opts.Topic == "" {
+		opts.Topic = "jetson/{hostname}/stats"
+	}
+	if opts.StatusTopic == "" {
+		opts.StatusTopic = "jetson/{hostname}/status"
+	}
+	opts.Topic = strings.ReplaceAll(opts.Topic, "{hostname}", opts.Hostname)
+	opts.StatusTopic = strings.ReplaceAll(opts.StatusTopic, "{hostname}", opts.Hostname)
+	if opts.ClientID == "" {
+		opts.ClientID = "jetson_exporter_" + opts.Hostname
+	}
+
+	m := &MQTT{
+		opts:    opts,
+		source:  source,
+		samples: make(chan *tegrastats.Sample, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	client := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetWill(opts.StatusTopic, mqttStatusOffline, opts.QoS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnf("mqtt: lost connection to %s: %s, reconnecting", opts.Broker, err)
+		})
+	if opts.CACert != "" || opts.ClientCert != "" {
+		config, err := mqttTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		client.SetTLSConfig(config)
+	}
+	m.client = mqtt.NewClient(client)
+	return m, nil
+}
+
+func mqttTLSConfig(opts MQTTOptions) (*tls.Config, error) {
+	config := &tls.Config{}
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt: no certificate in %s", opts.CACert)
+		}
+	}
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Start connects in the background, retrying until the broker is reachable, and publishes every sample from then on.
+func (m *MQTT) Start() {
+	log.Printf("Publishing samples to %s on %s", m.opts.Broker, m.opts.Topic)
+	m.client.Connect()
+	m.source.Subscribe(m.enqueue)
+	go m.run()
+}
+
+func (m *MQTT) onConnect(client mqtt.Client) {
+	log.Printf("mqtt: connected to %s", m.opts.Broker)
+	client.Publish(m.opts.StatusTopic, m.opts.QoS, true, mqttStatusOnline)
+}
+
+// enqueue hands a sample to run without blocking the source.
+func (m *MQTT) enqueue(sample *tegrastats.Sample) {
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+	select {
+	case m.samples <- sample:
+	default:
+		atomic.AddUint64(&m.skipped, 1)
+	}
+}
+
+func (m *MQTT) run() {
+	defer close(m.done)
+	for {
+		select {
+		case sample := <-m.samples:
+			m.publish(sample)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *MQTT) publish(sample *tegrastats.Sample) {
+	if !m.client.IsConnectionOpen() {
+		atomic.AddUint64(&m.failed, 1)
+		return
+	}
+	if !strings.Contains(m.opts.Topic, "{metric}") {
+		m.send(m.opts.Topic, sampleJSON(sample, m.opts.Hostname))
+		return
+	}
+	for _, field := range tegrastats.Flatten(sample) {
+		m.send(strings.ReplaceAll(m.opts.Topic, "{metric}", field.Name), []byte(strconv.FormatFloat(field.Value, 'f', -1, 64)))
+	}
+}
+
+func (m *MQTT) send(topic string, payload []byte) {
+	token := m.client.Publish(topic, m.opts.QoS, m.opts.Retain, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		atomic.AddUint64(&m.failed, 1)
+		log.Debugf("mqtt: publish to %s timed out", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		atomic.AddUint64(&m.failed, 1)
+		log.Debugf("mqtt: publish to %s: %s", topic, err)
+		return
+	}
+	atomic.AddUint64(&m.published, 1)
+}
+
+// Stop marks the exporter offline on the status topic and disconnects.
+func (m *MQTT) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.done
+		if m.client.IsConnectionOpen() {
+			m.client.Publish(m.opts.StatusTopic, m.opts.QoS, true, mqttStatusOffline).WaitTimeout(time.Second)
+		}
+		m.client.Disconnect(250)
+	})
+}
+
+// Describe implements prometheus.Collector for the MQTT self-metrics
+func (m *MQTT) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mqttConnectedDesc
+	ch <- mqttPublishedDesc
+	ch <- mqttFailedDesc
+	ch <- mqttSkippedDesc
+}
+
+// Collect implements prometheus.Collector for the MQTT self-metrics
+func (m *MQTT) Collect(ch chan<- prometheus.Metric) {
+	connected := 0.0
+	if m.client.IsConnectionOpen() {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(mqttConnectedDesc, prometheus.GaugeValue, connected)
+	ch <- prometheus.MustNewConstMetric(mqttPublishedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&m.published)))
+	ch <- prometheus.MustNewConstMetric(mqttFailedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&m.failed)))
+	ch <- prometheus.MustNewConstMetric(mqttSkippedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&m.skipped)))
+}
+
+// sampleJSON returns a sample as one JSON object: the hostname, the sample time and the values
+// named and ordered like the columns of the parse command. NaN and infinite values, which JSON
+// cannot carry, are left out.
+func sampleJSON(sample *tegrastats.Sample, hostname string) []byte {
+	var buf bytes.Buffer
+	host, _ := json.Marshal(hostname)
+	fmt.Fprintf(&buf, `{"hostname":%s`, host)
+	if !sample.Time.IsZero() {
+		fmt.Fprintf(&buf, `,"time":%q`, sample.Time.Format(time.RFC3339Nano))
+	}
+	for _, field := range tegrastats.Flatten(sample) {
+		if math.IsNaN(field.Value) || math.IsInf(field.Value, 0) {
+			continue
+		}
+		name, _ := json.Marshal(field.Name)
+		fmt.Fprintf(&buf, ",%s:%s", name, strconv.FormatFloat(field.Value, 'f', -1, 64))
+	}
+	buf.WriteString("}")
+	return buf.Bytes()
+}
@@ -0,0 +1,465 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/build"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// OTLPProtocolGRPC exports to the MetricsService of an OTLP/gRPC receiver, usually on port 4317.
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP posts binary protobuf to an OTLP/HTTP receiver, usually on port 4318.
+	OTLPProtocolHTTP = "http/protobuf"
+
+	otlpGRPCMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpScopeName  = "github.com/bearboy/jetson_prometheus_exporter"
+)
+
+// OTLPOptions configure the export of the exporter's metrics to an OpenTelemetry Collector.
+type OTLPOptions struct {
+	// Endpoint is host:port or a URL of the receiver, e.g. otel-collector:4317 for grpc or
+	// http://otel-collector:4318 for http/protobuf, where /v1/metrics is added when the URL has no path.
+	Endpoint string
+	// Protocol is OTLPProtocolGRPC (the default) or OTLPProtocolHTTP.
+	Protocol string
+	// Insecure talks plain text to a grpc Endpoint given as host:port.
+	Insecure bool
+	// Interval is how often the metrics are gathered and exported.
+	Interval time.Duration
+	// Timeout bounds one export.
+	Timeout time.Duration
+	// Headers are sent with every export, e.g. {"authorization": "Bearer <token>"}.
+	Headers map[string]string
+	// ResourceAttributes are added to the detected ones, host.name, device.model.name,
+	// jetson.l4t.version and so on, and win over them.
+	ResourceAttributes map[string]string
+	// Paths locate the device tree and /etc/nv_tegra_release the resource is detected from.
+	Paths Paths
+}
+
+// OTLP exports everything a prometheus.Gatherer gathers to an OpenTelemetry Collector on an interval.
+// Gauges stay gauges, counters become cumulative monotonic sums without the _total suffix and
+// histograms and summaries keep their buckets and quantiles; the unit is taken from the name suffix.
+// A failed export is not retried: the next one carries the current values and cumulative totals anyway.
+type OTLP struct {
+	opts     OTLPOptions
+	url      string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	resource *resourcepb.Resource
+	start    time.Time
+
+	points   uint64
+	failures uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	otlpDataPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "otlp", "data_points_total"),
+		"Data points exported to the OTLP endpoint.",
+		nil, nil,
+	)
+	otlpFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "otlp", "export_failures_total"),
+		"Exports the OTLP endpoint did not accept.",
+		nil, nil,
+	)
+)
+
+// NewOTLP returns an OTLP exporter sending the metrics of gatherer as configured by opts.
+func NewOTLP(opts OTLPOptions, gatherer prometheus.Gatherer) (*OTLP, error) {
+	if opts.Protocol == "" {
+		opts.Protocol = OTLPProtocolGRPC
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Paths == (Paths{}) {
+		opts.Paths = DefaultPaths()
+	}
+	o := &OTLP{opts: opts, gatherer: gatherer, start: time.Now()}
+	switch opts.Protocol {
+	case OTLPProtocolGRPC:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "localhost:4317"
+		}
+		scheme := "https"
+		if opts.Insecure {
+			scheme = "http"
+		}
+		if !strings.Contains(opts.Endpoint, "://") {
+			opts.Endpoint = scheme + "://" + opts.Endpoint
+		}
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("otlp endpoint: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("otlp endpoint %q: want host:port, http or https", opts.Endpoint)
+		}
+		o.url = u.Scheme + "://" + u.Host + otlpGRPCMethod
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			// gRPC without TLS is HTTP/2 with prior knowledge (h2c)
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, opts.Timeout)
+			}
+		}
+		o.client = &http.Client{Transport: transport, Timeout: opts.Timeout}
+	case OTLPProtocolHTTP:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "http://localhost:4318"
+		}
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("otlp endpoint: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("otlp endpoint %q: want http or https", opts.Endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		o.url = u.String()
+		o.client = &http.Client{Timeout: opts.Timeout}
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %q, want %s or %s", opts.Protocol, OTLPProtocolGRPC, OTLPProtocolHTTP)
+	}
+	o.opts = opts
+	o.resource = otlpResource(opts)
+	return o, nil
+}
+
+// Start exports in the background every Interval until Stop.
+func (o *OTLP) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.done = make(chan struct{})
+	log.Printf("Exporting metrics over OTLP (%s) to %s every %s", o.opts.Protocol, o.url, o.opts.Interval)
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(o.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := o.Export(ctx); err != nil && ctx.Err() == nil {
+					log.Errorf("otlp: %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops exporting, abandoning an export in flight.
+func (o *OTLP) Stop() {
+	if o.cancel != nil {
+		o.cancel()
+		<-o.done
+	}
+}
+
+// Export gathers once and sends the metrics in one request.
+func (o *OTLP) Export(ctx context.Context) error {
+	families, err := o.gatherer.Gather()
+	if err != nil {
+		// a failing collector still leaves the families of the others
+		log.Warnf("otlp: gather: %s", err)
+	}
+	metrics, points := toOTLPMetrics(families, o.start, time.Now())
+	if points == 0 {
+		return nil
+	}
+	body, err := proto.Marshal(&metricspb.MetricsData{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: o.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName, Version: build.BuildVersion},
+				Metrics: metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if o.opts.Protocol == OTLPProtocolGRPC {
+		err = o.sendGRPC(ctx, body)
+	} else {
+		err = o.sendHTTP(ctx, body)
+	}
+	if err != nil {
+		atomic.AddUint64(&o.failures, 1)
+		return err
+	}
+	atomic.AddUint64(&o.points, uint64(points))
+	return nil
+}
+
+// sendHTTP posts an ExportMetricsServiceRequest, which is encoded like the MetricsData in body.
+func (o *OTLP) sendHTTP(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	o.setHeaders(req)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendGRPC calls MetricsService/Export: the request is one length-prefixed message and
+// the outcome is the grpc-status trailer, or header when the server answered with trailers only.
+func (o *OTLP) sendGRPC(ctx context.Context, body []byte) error {
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(body)))
+	copy(frame[5:], body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	o.setHeaders(req)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(msg); err == nil {
+			msg = m
+		}
+		return fmt.Errorf("grpc status %q: %s", status, msg)
+	}
+	return nil
+}
+
+func (o *OTLP) setHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", "jetson_exporter")
+	for name, value := range o.opts.Headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// Describe implements prometheus.Collector for the OTLP self-metrics
+func (o *OTLP) Describe(ch chan<- *prometheus.Desc) {
+	ch <- otlpDataPointsDesc
+	ch <- otlpFailuresDesc
+}
+
+// Collect implements prometheus.Collector for the OTLP self-metrics
+func (o *OTLP) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(otlpDataPointsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&o.points)))
+	ch <- prometheus.MustNewConstMetric(otlpFailuresDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&o.failures)))
+}
+
+// nvTegraReleaseRE matches the first line of /etc/nv_tegra_release, e.g.
+// "# R35 (release), REVISION: 4.1, GCID: 33958178, BOARD: t186ref, ..."
+var nvTegraReleaseRE = regexp.MustCompile(`^# R(\d+) \(release\), REVISION: ([\d.]+)`)
+
+// otlpResource returns the resource describing this board with the semantic convention attributes.
+func otlpResource(opts OTLPOptions) *resourcepb.Resource {
+	attrs := map[string]string{
+		"service.name":        "jetson_exporter",
+		"service.version":     build.BuildVersion,
+		"host.arch":           runtime.GOARCH,
+		"os.type":             runtime.GOOS,
+		"device.manufacturer": "NVIDIA",
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attrs["host.name"] = hostname
+	}
+	if model, err := os.ReadFile(opts.Paths.proc("device-tree", "model")); err == nil {
+		attrs["device.model.name"] = strings.TrimRight(string(model), "\x00\n")
+	}
+	if release, err := os.ReadFile(opts.Paths.root("etc", "nv_tegra_release")); err == nil {
+		if m := nvTegraReleaseRE.FindSubmatch(release); m != nil {
+			attrs["jetson.l4t.version"] = string(m[1]) + "." + string(m[2])
+		}
+	}
+	for name, value := range opts.ResourceAttributes {
+		attrs[name] = value
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resource := &resourcepb.Resource{}
+	for _, name := range names {
+		resource.Attributes = append(resource.Attributes, otlpAttribute(name, attrs[name]))
+	}
+	return resource
+}
+
+func otlpAttribute(name, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: name, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// otlpUnits are the UCUM units of the base-unit name suffixes.
+var otlpUnits = []struct{ suffix, unit string }{
+	{"_bytes", "By"},
+	{"_seconds", "s"},
+	{"_hertz", "Hz"},
+	{"_watts", "W"},
+	{"_joules", "J"},
+	{"_celsius", "Cel"},
+	{"_ratio", "1"},
+}
+
+// toOTLPMetrics converts metric families to OTLP metrics and counts their data points.
+// Counters start at start, every point without a timestamp of its own is taken at now.
+func toOTLPMetrics(families []*dto.MetricFamily, start, now time.Time) ([]*metricspb.Metric, int) {
+	var metrics []*metricspb.Metric
+	points := 0
+	for _, family := range families {
+		name := family.GetName()
+		if family.GetType() == dto.MetricType_COUNTER {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		metric := &metricspb.Metric{Name: name, Description: family.GetHelp()}
+		for _, u := range otlpUnits {
+			if strings.HasSuffix(name, u.suffix) {
+				metric.Unit = u.unit
+				break
+			}
+		}
+		var (
+			numbers    []*metricspb.NumberDataPoint
+			histograms []*metricspb.HistogramDataPoint
+			summaries  []*metricspb.SummaryDataPoint
+		)
+		for _, m := range family.Metric {
+			ts := uint64(now.UnixNano())
+			if m.TimestampMs != nil {
+				ts = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+			}
+			attrs := make([]*commonpb.KeyValue, 0, len(m.Label))
+			for _, l := range m.Label {
+				attrs = append(attrs, otlpAttribute(l.GetName(), l.GetValue()))
+			}
+			number := func(value float64) *metricspb.NumberDataPoint {
+				return &metricspb.NumberDataPoint{Attributes: attrs, TimeUnixNano: ts, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: value}}
+			}
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				numbers = append(numbers, number(m.GetGauge().GetValue()))
+			case dto.MetricType_UNTYPED:
+				numbers = append(numbers, number(m.GetUntyped().GetValue()))
+			case dto.MetricType_COUNTER:
+				p := number(m.GetCounter().GetValue())
+				p.StartTimeUnixNano = uint64(start.UnixNano())
+				numbers = append(numbers, p)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				sum := h.GetSampleSum()
+				p := &metricspb.HistogramDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					TimeUnixNano:      ts,
+					Count:             h.GetSampleCount(),
+					Sum:               &sum,
+				}
+				// Prometheus buckets are cumulative and may end in +Inf, OTLP ones are not and always end in an implicit +Inf
+				var below uint64
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+					p.BucketCounts = append(p.BucketCounts, b.GetCumulativeCount()-below)
+					below = b.GetCumulativeCount()
+				}
+				p.BucketCounts = append(p.BucketCounts, h.GetSampleCount()-below)
+				histograms = append(histograms, p)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				p := &metricspb.SummaryDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					TimeUnixNano:      ts,
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.Quantile {
+					p.QuantileValues = append(p.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				summaries = append(summaries, p)
+			}
+		}
+		switch family.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numbers}}
+			points += len(numbers)
+		case dto.MetricType_COUNTER:
+			metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             numbers,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+			points += len(numbers)
+		case dto.MetricType_HISTOGRAM:
+			metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				DataPoints:             histograms,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}}
+			points += len(histograms)
+		case dto.MetricType_SUMMARY:
+			metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: summaries}}
+			points += len(summaries)
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, points
+}
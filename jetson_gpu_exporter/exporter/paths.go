@@ -0,0 +1,41 @@
+package exporter
+
+import "path/filepath"
+
+// Paths locates the filesystems the collectors read, so the exporter can run
+// in a container with the host mounted at e.g. /host, or against a fake tree in tests.
+// An empty field stands for the mount point of the host.
+type Paths struct {
+	Sysfs  string
+	Procfs string
+	Rootfs string
+}
+
+// DefaultPaths are the filesystems of the host the exporter runs on.
+func DefaultPaths() Paths {
+	return Paths{Sysfs: "/sys", Procfs: "/proc", Rootfs: "/"}
+}
+
+// sys joins elem to the sysfs mount point.
+func (p Paths) sys(elem ...string) string {
+	return mount(p.Sysfs, "/sys", elem)
+}
+
+// proc joins elem to the procfs mount point.
+func (p Paths) proc(elem ...string) string {
+	return mount(p.Procfs, "/proc", elem)
+}
+
+// root joins elem to the root filesystem mount point.
+func (p Paths) root(elem ...string) string {
+	return mount(p.Rootfs, "/", elem)
+}
+
+// mount joins elem to dir, or to def when dir is unset: a zero Paths reads the host
+// instead of paths relative to the working directory.
+func mount(dir, def string, elem []string) string {
+	if dir == "" {
+		dir = def
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
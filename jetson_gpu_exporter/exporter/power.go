@@ -0,0 +1,39 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("power", true, newPowerCollector)
+}
+
+var (
+	railPowerDesc        = newDesc("rail_power_watts", "Instantaneous power of a rail in watts.", "rail")
+	railAveragePowerDesc = newDesc("rail_average_power_watts", "Average power of a rail in watts since tegrastats started.", "rail")
+)
+
+type powerCollector struct {
+	energy *energyMeter
+}
+
+func newPowerCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyPowerCollector()
+	}
+	return withStats(&powerCollector{energy: opts.energy}, opts.stats, opts.stats.rail)
+}
+
+// Update sends the energy counters even for a sample without rails, a counter must not disappear.
+func (c *powerCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	c.energy.collect(ch)
+	if len(sample.Rails) == 0 {
+		return errNoData
+	}
+	for name, rail := range sample.Rails {
+		sendGauge(ch, railPowerDesc, rail.CurrentMilliwatts*milliwatts, name)
+		sendGauge(ch, railAveragePowerDesc, rail.AverageMilliwatts*milliwatts, name)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// recordHeaderSize is the length, checksum, time and sample count in front of every record.
+	recordHeaderSize = 20
+	minSegmentSize   = 64 << 10
+	maxSegmentSize   = 8 << 20
+	segmentSuffix    = ".seg"
+	cursorFile       = "cursor"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// batch is the push of one gather: its time, how many samples it holds and the encoded request.
+type batch struct {
+	at      time.Time
+	samples int
+	body    []byte
+	// seq and offset locate a batch read from the queue
+	seq    uint64
+	offset int64
+}
+
+// segment is one file of the queue, named after its sequence number.
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// diskQueue is a write-ahead queue of batches kept in segment files under dir.
+// Every batch is synced to disk before append returns and checksummed, so a crash loses
+// at most the batch being written; a torn record at the end of a segment is cut off on open.
+// The read position is kept in a cursor file, a crash between sending a batch and saving
+// the cursor sends it twice, which remote_write receivers ignore.
+// The queue drops its oldest batches beyond maxBytes, and batches older than maxAge when they are read.
+type diskQueue struct {
+	dir         string
+	maxBytes    int64
+	maxAge      time.Duration
+	segmentSize int64
+
+	mu       sync.Mutex
+	segments []segment
+	write    *os.File
+	read     *os.File
+	// readSeq and readOffset point at the next batch to send
+	readSeq    uint64
+	readOffset int64
+	samples    int
+	oldest     time.Time
+	dropped    uint64
+	// ready is signalled, without blocking, when a batch is appended
+	ready chan struct{}
+}
+
+// openDiskQueue opens the queue in dir, creating it when missing, and recovers what a crash left behind.
+func openDiskQueue(dir string, maxBytes int64, maxAge time.Duration) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segmentSize := maxBytes / 16
+	if segmentSize < minSegmentSize {
+		segmentSize = minSegmentSize
+	}
+	if segmentSize > maxSegmentSize {
+		segmentSize = maxSegmentSize
+	}
+	q := &diskQueue{dir: dir, maxBytes: maxBytes, maxAge: maxAge, segmentSize: segmentSize, ready: make(chan struct{}, 1)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), segmentSuffix) {
+			continue
+		}
+		q.segments = append(q.segments, segment{seq: seq})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+	q.readCursor()
+	// segments before the cursor were sent already
+	for len(q.segments) > 0 && q.segments[0].seq < q.readSeq {
+		q.remove(q.segments[0].seq)
+		q.segments = q.segments[1:]
+	}
+	for i := range q.segments {
+		if err := q.recover(&q.segments[i]); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.segments) == 0 || q.readSeq < q.segments[0].seq {
+		q.readSeq, q.readOffset = 0, 0
+		if len(q.segments) > 0 {
+			q.readSeq = q.segments[0].seq
+		}
+	} else if head := q.segments[0]; q.readOffset > head.size {
+		// the cursor points past a torn record that was cut off
+		q.readOffset = head.size
+	}
+	if err := q.openWrite(); err != nil {
+		return nil, err
+	}
+	q.count()
+	if q.samples > 0 {
+		log.Printf("remote_write queue %s holds %d samples since %s", dir, q.samples, q.oldest.Format(time.RFC3339))
+	}
+	return q, nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d%s", seq, segmentSuffix))
+}
+
+// readCursor loads the read position saved by the last commit.
+func (q *diskQueue) readCursor() {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil {
+		return
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &q.readSeq, &q.readOffset); err != nil {
+		// everything still on disk is sent again rather than lost
+		log.Warnf("remote_write queue: ignoring broken cursor %q, resending the queue from its start", data)
+		q.readSeq, q.readOffset = 0, 0
+	}
+}
+
+// writeCursor saves the read position. The new cursor is synced before the rename replaces
+// the old one and the directory after it, so a power loss leaves either of them, never an empty file.
+func (q *diskQueue) writeCursor() error {
+	tmp := filepath.Join(q.dir, cursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", q.readSeq, q.readOffset); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, cursorFile)); err != nil {
+		return err
+	}
+	return q.syncDir()
+}
+
+// syncDir makes the creation, removal and renaming of files in the queue directory durable.
+func (q *diskQueue) syncDir() error {
+	d, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// remove deletes a segment that was sent or dropped.
+func (q *diskQueue) remove(seq uint64) {
+	if err := os.Remove(q.path(seq)); err != nil {
+		log.Warnf("remote_write queue: %s", err)
+		return
+	}
+	if err := q.syncDir(); err != nil {
+		log.Warnf("remote_write queue: sync %s: %s", q.dir, err)
+	}
+}
+
+// recover sizes a segment and cuts off a record torn by a crash, together with everything after it.
+func (q *diskQueue) recover(s *segment) error {
+	f, err := os.OpenFile(q.path(s.seq), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var offset int64
+	for {
+		_, size, err := readBatch(f, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warnf("remote_write queue: %s at offset %d of %s, truncating", err, offset, f.Name())
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += size
+	}
+	s.size = offset
+	return nil
+}
+
+// openWrite appends to the newest segment, or starts the first one.
+func (q *diskQueue) openWrite() error {
+	if len(q.segments) == 0 {
+		return q.rotate()
+	}
+	last := q.segments[len(q.segments)-1]
+	f, err := os.OpenFile(q.path(last.seq), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	q.write = f
+	return nil
+}
+
+// rotate closes the segment being written and starts the next one.
+func (q *diskQueue) rotate() error {
+	seq := q.readSeq
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1].seq + 1
+	}
+	f, err := os.OpenFile(q.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// the records synced into the segment are lost if its directory entry is not
+	if err := q.syncDir(); err != nil {
+		f.Close()
+		return err
+	}
+	if q.write != nil {
+		q.write.Close()
+	}
+	q.write = f
+	q.segments = append(q.segments, segment{seq: seq})
+	if len(q.segments) == 1 {
+		q.readSeq, q.readOffset = seq, 0
+	}
+	return nil
+}
+
+// count sums the unsent samples and finds the oldest unsent batch.
+func (q *diskQueue) count() {
+	q.samples, q.oldest = 0, time.Time{}
+	for _, s := range q.segments {
+		q.scan(s, func(b *batch) {
+			if q.oldest.IsZero() {
+				q.oldest = b.at
+			}
+			q.samples += b.samples
+		})
+	}
+}
+
+// scan calls fn with every unsent batch of s.
+func (q *diskQueue) scan(s segment, fn func(b *batch)) {
+	f, err := os.Open(q.path(s.seq))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var offset int64
+	if s.seq == q.readSeq {
+		offset = q.readOffset
+	}
+	for offset < s.size {
+		b, size, err := readBatch(f, offset)
+		if err != nil {
+			return
+		}
+		fn(b)
+		offset += size
+	}
+}
+
+// append writes b and syncs it, then drops the oldest segments beyond maxBytes.
+func (q *diskQueue) append(b *batch) error {
+	if len(b.body) > maxSegmentSize {
+		return fmt.Errorf("batch of %d bytes is too large for the queue", len(b.body))
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	last := &q.segments[len(q.segments)-1]
+	if last.size >= q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+	record := make([]byte, recordHeaderSize+len(b.body))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(b.body)))
+	binary.BigEndian.PutUint64(record[8:], uint64(b.at.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint32(record[16:], uint32(b.samples))
+	copy(record[recordHeaderSize:], b.body)
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(record[8:], crcTable))
+	if _, err := q.write.Write(record); err != nil {
+		return err
+	}
+	if err := q.write.Sync(); err != nil {
+		return err
+	}
+	last.size += int64(len(record))
+	if q.oldest.IsZero() {
+		q.oldest = b.at
+	}
+	q.samples += b.samples
+	q.trim()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// trim drops whole segments, oldest first, until the queue fits into maxBytes.
+// The segment being written is never dropped.
+func (q *diskQueue) trim() {
+	total := int64(0)
+	for _, s := range q.segments {
+		total += s.size
+	}
+	dropped := 0
+	for total > q.maxBytes && len(q.segments) > 1 {
+		s := q.segments[0]
+		q.scan(s, func(b *batch) { dropped += b.samples })
+		if q.read != nil {
+			q.read.Close()
+			q.read = nil
+		}
+		q.remove(s.seq)
+		q.segments = q.segments[1:]
+		total -= s.size
+		q.readSeq, q.readOffset = q.segments[0].seq, 0
+	}
+	if dropped > 0 {
+		log.Warnf("remote_write queue is full, dropped the oldest %d samples", dropped)
+		q.dropped += uint64(dropped)
+		q.writeCursor()
+		q.count()
+	}
+}
+
+// peek returns the oldest unsent batch without removing it, or nil when everything was sent.
+// Batches older than maxAge are dropped on the way.
+func (q *diskQueue) peek(now time.Time) (*batch, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		b, err := q.head()
+		if b == nil || err != nil {
+			return nil, err
+		}
+		if q.maxAge <= 0 || now.Sub(b.at) <= q.maxAge {
+			return b, nil
+		}
+		q.dropped += uint64(b.samples)
+		if err := q.advance(b); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// head reads the batch at the cursor, moving on to the next segment at the end of one.
+func (q *diskQueue) head() (*batch, error) {
+	for {
+		i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i].seq >= q.readSeq })
+		if i == len(q.segments) {
+			return nil, nil
+		}
+		s := q.segments[i]
+		if q.readOffset < s.size {
+			if q.read == nil || q.read.Name() != q.path(s.seq) {
+				if q.read != nil {
+					q.read.Close()
+				}
+				f, err := os.Open(q.path(s.seq))
+				if err != nil {
+					return nil, err
+				}
+				q.read = f
+			}
+			b, _, err := readBatch(q.read, q.readOffset)
+			if err == nil {
+				b.seq, b.offset = s.seq, q.readOffset
+			}
+			if err != nil {
+				// only a disk fault gets here, appended records are checked on open
+				log.Errorf("remote_write queue: %s in %s, skipping the rest of it", err, q.read.Name())
+				q.readOffset = s.size
+				continue
+			}
+			return b, nil
+		}
+		if i == len(q.segments)-1 {
+			return nil, nil
+		}
+		// the segment was sent completely
+		if q.read != nil {
+			q.read.Close()
+			q.read = nil
+		}
+		q.remove(s.seq)
+		q.segments = append(q.segments[:i], q.segments[i+1:]...)
+		q.readSeq, q.readOffset = q.segments[i].seq, 0
+	}
+}
+
+// commit removes b, the batch peek returned, once it was sent.
+// Nothing happens when b was dropped from a full queue in the meantime.
+func (q *diskQueue) commit(b *batch) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if b.seq != q.readSeq || b.offset != q.readOffset {
+		return nil
+	}
+	return q.advance(b)
+}
+
+func (q *diskQueue) advance(b *batch) error {
+	q.readOffset += int64(recordHeaderSize + len(b.body))
+	q.samples -= b.samples
+	q.oldest = time.Time{}
+	if next, err := q.head(); err == nil && next != nil {
+		q.oldest = next.at
+	}
+	return q.writeCursor()
+}
+
+// stats returns the unsent samples, the bytes on disk, the time of the oldest unsent batch and the dropped samples.
+func (q *diskQueue) stats() (samples int, bytes int64, oldest time.Time, dropped uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range q.segments {
+		bytes += s.size
+	}
+	return q.samples, bytes, q.oldest, q.dropped
+}
+
+func (q *diskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.write != nil {
+		q.write.Close()
+	}
+	if q.read != nil {
+		q.read.Close()
+	}
+}
+
+var errBadRecord = errors.New("corrupt record")
+
+// readBatch reads the record at offset and returns it with its size on disk.
+func readBatch(f *os.File, offset int64) (*batch, int64, error) {
+	var header [recordHeaderSize]byte
+	n, err := f.ReadAt(header[:], offset)
+	if err == io.EOF && n == 0 {
+		return nil, 0, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, 0, errBadRecord
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	if length > maxSegmentSize {
+		return nil, 0, errBadRecord
+	}
+	record := make([]byte, recordHeaderSize-8+int(length))
+	copy(record, header[8:])
+	if _, err := f.ReadAt(record[recordHeaderSize-8:], offset+recordHeaderSize); err != nil {
+		return nil, 0, errBadRecord
+	}
+	if crc32.Checksum(record, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errBadRecord
+	}
+	ms := int64(binary.BigEndian.Uint64(header[8:]))
+	return &batch{
+		at:      time.Unix(0, ms*int64(time.Millisecond)),
+		samples: int(binary.BigEndian.Uint32(header[16:])),
+		body:    record[recordHeaderSize-8:],
+	}, int64(recordHeaderSize) + int64(length), nil
+}
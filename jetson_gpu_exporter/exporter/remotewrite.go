@@ -0,0 +1,636 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minRemoteWriteBackoff = 500 * time.Millisecond
+	maxRemoteWriteBackoff = 30 * time.Second
+)
+
+const (
+	// PushFormatRemoteWrite pushes snappy-compressed protobuf to a Prometheus remote_write endpoint.
+	PushFormatRemoteWrite = "remote-write"
+	// PushFormatJSON pushes one JSON object per series and line,
+	// {"metric":{"__name__":...},"values":[...],"timestamps":[...]}, as VictoriaMetrics /api/v1/import takes it.
+	PushFormatJSON = "json"
+)
+
+// RemoteWriteOptions configure the push of the exporter's samples to a Prometheus remote_write endpoint.
+type RemoteWriteOptions struct {
+	// URL is the remote_write endpoint, e.g. http://prometheus:9090/api/v1/write.
+	URL string
+	// Interval is how often the samples are gathered and pushed.
+	Interval time.Duration
+	// Timeout bounds one push request.
+	Timeout time.Duration
+	// Format is PushFormatRemoteWrite (the default) or PushFormatJSON.
+	Format string
+	// Retries is how often a push failing with a network error, 429 or 5xx is retried
+	// before its samples are dropped. It does not apply with a QueueDir.
+	Retries int
+	// Username and Password enable basic auth, BearerToken a bearer token.
+	Username    string
+	Password    string
+	BearerToken string
+	// ExternalLabels are added to every series that has no label of the same name,
+	// e.g. {"device": "jetson-07"} to tell the boards apart on the receiver.
+	ExternalLabels map[string]string
+
+	// QueueDir, when set, keeps every gathered batch in a write-ahead queue on disk until the
+	// endpoint took it, so nothing is lost while the uplink is down; the batches are sent in order
+	// once it is back. The queue keeps at most QueueMaxBytes and drops batches older than QueueMaxAge.
+	// A Prometheus receiver rejects samples older than its head block as out of bounds unless
+	// out-of-order ingestion (out_of_order_time_window) is enabled; those rejections are counted
+	// in nvidia_jetson_remote_write_replay_rejected_samples_total.
+	QueueDir      string
+	QueueMaxBytes int64
+	QueueMaxAge   time.Duration
+}
+
+// RemoteWrite pushes everything a prometheus.Gatherer gathers to a remote_write endpoint on an interval,
+// for boards behind NAT or on cellular links that a central Prometheus cannot scrape.
+type RemoteWrite struct {
+	opts     RemoteWriteOptions
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	queue *diskQueue
+
+	samples uint64
+	dropped uint64
+	retries uint64
+	// replayRejected counts the samples of batches the endpoint rejected after they waited in the queue
+	replayRejected uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	remoteWriteSamplesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "samples_total"),
+		"Samples pushed to the remote_write endpoint.",
+		nil, nil,
+	)
+	remoteWriteDroppedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "dropped_samples_total"),
+		"Samples dropped because the remote_write endpoint rejected them or stayed unreachable, except replayed ones it rejected.",
+		nil, nil,
+	)
+	remoteWriteRetriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "retries_total"),
+		"Push requests retried after a network error, 429 or 5xx.",
+		nil, nil,
+	)
+	remoteWriteReplayRejectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "replay_rejected_samples_total"),
+		"Samples replayed from the on-disk queue after an outage or a restart that the remote_write endpoint rejected, e.g. as out of bounds.",
+		nil, nil,
+	)
+	remoteWriteQueueSamplesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "queue_samples"),
+		"Samples waiting in the on-disk queue to be sent.",
+		nil, nil,
+	)
+	remoteWriteQueueBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "queue_bytes"),
+		"Size of the on-disk queue in bytes.",
+		nil, nil,
+	)
+	remoteWriteQueueLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "remote_write", "queue_lag_seconds"),
+		"Age of the oldest sample waiting in the on-disk queue, 0 when the queue is empty.",
+		nil, nil,
+	)
+)
+
+// NewRemoteWrite returns a RemoteWrite pushing the samples of gatherer as configured by opts.
+func NewRemoteWrite(opts RemoteWriteOptions, gatherer prometheus.Gatherer) (*RemoteWrite, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("remote_write url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("remote_write url %q: want http or https", opts.URL)
+	}
+	if opts.BearerToken != "" && opts.Username != "" {
+		return nil, fmt.Errorf("remote_write: basic auth and a bearer token are mutually exclusive")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = PushFormatRemoteWrite
+	case PushFormatRemoteWrite, PushFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown push format %q, want %s or %s", opts.Format, PushFormatRemoteWrite, PushFormatJSON)
+	}
+	w := &RemoteWrite{
+		opts:     opts,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: opts.Timeout},
+	}
+	if opts.QueueDir != "" {
+		if opts.QueueMaxBytes <= 0 {
+			opts.QueueMaxBytes = 256 << 20
+		}
+		w.queue, err = openDiskQueue(opts.QueueDir, opts.QueueMaxBytes, opts.QueueMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("open remote_write queue: %s", err)
+		}
+	}
+	return w, nil
+}
+
+// Start pushes in the background every Interval until Stop.
+func (w *RemoteWrite) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	log.Printf("Pushing metrics to %s every %s", w.opts.URL, w.opts.Interval)
+	var wg sync.WaitGroup
+	if w.queue != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.forward(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(w.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Push(ctx); err != nil && ctx.Err() == nil {
+					log.Errorf("remote_write: %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(w.done)
+	}()
+}
+
+// Stop stops pushing, abandoning a push that is being retried.
+// Queued batches stay on disk and are sent after the next Start.
+func (w *RemoteWrite) Stop() {
+	if w.cancel != nil {
+		w.cancel()
+		<-w.done
+	}
+	if w.queue != nil {
+		w.queue.close()
+	}
+}
+
+// Push gathers once and sends the samples, or appends them to the queue when there is one.
+// Without a queue the samples are dropped when every attempt failed.
+func (w *RemoteWrite) Push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		// a failing collector still leaves the families of the others
+		log.Warnf("remote_write: gather: %s", err)
+	}
+	now := time.Now()
+	series := toRemoteSeries(families, now, w.opts.ExternalLabels)
+	if len(series) == 0 {
+		return nil
+	}
+	b := &batch{at: now, samples: len(series), body: snappy.Encode(nil, encodeWriteRequest(series))}
+	if w.queue != nil {
+		return w.queue.append(b)
+	}
+	backoff := minRemoteWriteBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(ctx, b.body)
+		if err == nil {
+			atomic.AddUint64(&w.samples, uint64(b.samples))
+			return nil
+		}
+		if !retry || attempt == w.opts.Retries {
+			atomic.AddUint64(&w.dropped, uint64(b.samples))
+			return fmt.Errorf("dropped %d samples: %s", b.samples, err)
+		}
+		atomic.AddUint64(&w.retries, 1)
+		log.Debugf("remote_write: %s, retrying in %s", err, backoff)
+		if !sleep(ctx, backoff) {
+			atomic.AddUint64(&w.dropped, uint64(b.samples))
+			return ctx.Err()
+		}
+		backoff = nextRemoteWriteBackoff(backoff)
+	}
+}
+
+// forward sends the queued batches in order until ctx is done, retrying each one
+// until the endpoint takes it, rejects it or it ages out of the queue.
+// Batches waiting since before the endpoint last failed, or since before Start, count as replayed
+// until the queue is empty again.
+func (w *RemoteWrite) forward(ctx context.Context) {
+	backoff := minRemoteWriteBackoff
+	down := false
+	queued, _, _, _ := w.queue.stats()
+	replaying := queued > 0
+	for {
+		b, err := w.queue.peek(time.Now())
+		if err != nil {
+			log.Errorf("remote_write queue: %s", err)
+			if !sleep(ctx, maxRemoteWriteBackoff) {
+				return
+			}
+			continue
+		}
+		if b == nil {
+			replaying = false
+			select {
+			case <-w.queue.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		retry, err := w.send(ctx, b.body)
+		if err != nil && retry {
+			if ctx.Err() != nil {
+				return
+			}
+			if !down {
+				log.Warnf("remote_write: %s, queueing samples until %s is reachable", err, w.opts.URL)
+				down = true
+				replaying = true
+			}
+			atomic.AddUint64(&w.retries, 1)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = nextRemoteWriteBackoff(backoff)
+			continue
+		}
+		if down {
+			samples, _, oldest, _ := w.queue.stats()
+			log.Printf("remote_write: %s is reachable again, sending %d queued samples since %s", w.opts.URL, samples, oldest.Format(time.RFC3339))
+			down = false
+		}
+		backoff = minRemoteWriteBackoff
+		switch {
+		case err != nil && replaying:
+			log.Errorf("remote_write: %s rejected %d samples queued since %s: %s; a Prometheus receiver only takes them with out_of_order_time_window",
+				w.opts.URL, b.samples, b.at.Format(time.RFC3339), err)
+			atomic.AddUint64(&w.replayRejected, uint64(b.samples))
+		case err != nil:
+			log.Errorf("remote_write: dropped %d samples: %s", b.samples, err)
+			atomic.AddUint64(&w.dropped, uint64(b.samples))
+		default:
+			atomic.AddUint64(&w.samples, uint64(b.samples))
+		}
+		if err := w.queue.commit(b); err != nil {
+			log.Errorf("remote_write queue: %s", err)
+		}
+	}
+}
+
+// sleep waits for d and reports whether ctx is still running.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func nextRemoteWriteBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxRemoteWriteBackoff {
+		return maxRemoteWriteBackoff
+	}
+	return backoff
+}
+
+// send posts one request and reports whether a failure is worth retrying.
+func (w *RemoteWrite) send(ctx context.Context, body []byte) (retry bool, err error) {
+	contentType := "application/x-protobuf"
+	if w.opts.Format == PushFormatJSON {
+		if body, err = toJSONLines(body); err != nil {
+			return false, err
+		}
+		contentType = "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "jetson_exporter")
+	if w.opts.Format == PushFormatRemoteWrite {
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
+	if w.opts.Username != "" {
+		req.SetBasicAuth(w.opts.Username, w.opts.Password)
+	} else if w.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.opts.BearerToken)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// Describe implements prometheus.Collector for the remote_write self-metrics
+func (w *RemoteWrite) Describe(ch chan<- *prometheus.Desc) {
+	ch <- remoteWriteSamplesDesc
+	ch <- remoteWriteDroppedDesc
+	ch <- remoteWriteRetriesDesc
+	if w.queue != nil {
+		ch <- remoteWriteReplayRejectedDesc
+		ch <- remoteWriteQueueSamplesDesc
+		ch <- remoteWriteQueueBytesDesc
+		ch <- remoteWriteQueueLagDesc
+	}
+}
+
+// Collect implements prometheus.Collector for the remote_write self-metrics
+func (w *RemoteWrite) Collect(ch chan<- prometheus.Metric) {
+	dropped := atomic.LoadUint64(&w.dropped)
+	if w.queue != nil {
+		samples, bytes, oldest, queueDropped := w.queue.stats()
+		dropped += queueDropped
+		lag := 0.0
+		if !oldest.IsZero() {
+			lag = time.Since(oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(remoteWriteQueueSamplesDesc, prometheus.GaugeValue, float64(samples))
+		ch <- prometheus.MustNewConstMetric(remoteWriteQueueBytesDesc, prometheus.GaugeValue, float64(bytes))
+		ch <- prometheus.MustNewConstMetric(remoteWriteQueueLagDesc, prometheus.GaugeValue, lag)
+		ch <- prometheus.MustNewConstMetric(remoteWriteReplayRejectedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&w.replayRejected)))
+	}
+	ch <- prometheus.MustNewConstMetric(remoteWriteSamplesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&w.samples)))
+	ch <- prometheus.MustNewConstMetric(remoteWriteDroppedDesc, prometheus.CounterValue, float64(dropped))
+	ch <- prometheus.MustNewConstMetric(remoteWriteRetriesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&w.retries)))
+}
+
+type remoteLabel struct {
+	name, value string
+}
+
+// remoteSeries is one sample of a series, with its labels sorted by name as remote_write requires.
+type remoteSeries struct {
+	labels    []remoteLabel
+	value     float64
+	timestamp int64
+}
+
+// toRemoteSeries flattens metric families into series the way Prometheus stores them:
+// histograms and summaries become their _bucket/quantile, _sum and _count series.
+func toRemoteSeries(families []*dto.MetricFamily, now time.Time, external map[string]string) []remoteSeries {
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	var series []remoteSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			ts := nowMs
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...remoteLabel) {
+				labels := []remoteLabel{{"__name__", name}}
+				for _, l := range m.Label {
+					labels = append(labels, remoteLabel{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				series = append(series, remoteSeries{labels: withExternalLabels(labels, external), value: value, timestamp: ts})
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), remoteLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				if n := len(h.Bucket); n == 0 || !math.IsInf(h.Bucket[n-1].GetUpperBound(), +1) {
+					add(name+"_bucket", float64(h.GetSampleCount()), remoteLabel{"le", "+Inf"})
+				}
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add(name, q.GetValue(), remoteLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// withExternalLabels adds the external labels the series does not have itself and sorts them all by name.
+func withExternalLabels(labels []remoteLabel, external map[string]string) []remoteLabel {
+	have := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		have[l.name] = true
+	}
+	for name, value := range external {
+		if !have[name] {
+			labels = append(labels, remoteLabel{name, value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var req, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// decodeWriteRequest reverses encodeWriteRequest for a snappy-compressed request.
+func decodeWriteRequest(body []byte) ([]remoteSeries, error) {
+	req, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var series []remoteSeries
+	err = eachMessage(req, func(num protowire.Number, ts []byte) error {
+		var s remoteSeries
+		err := eachMessage(ts, func(num protowire.Number, msg []byte) error {
+			if num == 2 {
+				return decodeSample(msg, &s)
+			}
+			var l remoteLabel
+			err := eachMessage(msg, func(num protowire.Number, v []byte) error {
+				if num == 1 {
+					l.name = string(v)
+				} else {
+					l.value = string(v)
+				}
+				return nil
+			})
+			s.labels = append(s.labels, l)
+			return err
+		})
+		series = append(series, s)
+		return err
+	})
+	return series, err
+}
+
+// eachMessage calls fn with the payload of every length-delimited field of a protobuf message.
+func eachMessage(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return errBadRecord
+		}
+		v, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			return errBadRecord
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n+m:]
+	}
+	return nil
+}
+
+func decodeSample(b []byte, s *remoteSeries) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadRecord
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, m := protowire.ConsumeFixed64(b)
+			if m < 0 {
+				return errBadRecord
+			}
+			s.value = math.Float64frombits(v)
+			b = b[m:]
+		case num == 2 && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return errBadRecord
+			}
+			s.timestamp = int64(v)
+			b = b[m:]
+		default:
+			return errBadRecord
+		}
+	}
+	return nil
+}
+
+// jsonSeries is one line of PushFormatJSON.
+type jsonSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// toJSONLines converts a snappy-compressed remote_write request into PushFormatJSON.
+func toJSONLines(body []byte) ([]byte, error) {
+	series, err := decodeWriteRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range series {
+		metric := make(map[string]string, len(s.labels))
+		for _, l := range s.labels {
+			metric[l.name] = l.value
+		}
+		// JSON has no NaN or Inf, e.g. a min gauge of an empty stats window
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		if err := enc.Encode(jsonSeries{Metric: metric, Values: []float64{s.value}, Timestamps: []int64{s.timestamp}}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,179 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ModeReplay serves the samples of a recording made by the record command, selected with --source=replay:<file>.
+const ModeReplay = "replay"
+
+// RecordTimeLayout is the receive time in front of every line of a recording:
+//
+//	<receive time>\t<tegrastats line>
+const RecordTimeLayout = time.RFC3339Nano
+
+// WriteRecord appends one tegrastats line received at at to a recording.
+func WriteRecord(w io.Writer, at time.Time, line string) error {
+	_, err := fmt.Fprintf(w, "%s\t%s\n", at.Format(RecordTimeLayout), line)
+	return err
+}
+
+// ParseRecord splits a line of a recording into its receive time and the tegrastats line.
+// ok is false for a line without a receive time, e.g. from a plain tegrastats logfile.
+func ParseRecord(text string) (at time.Time, line string, ok bool) {
+	i := strings.IndexByte(text, '\t')
+	if i <= 0 {
+		return time.Time{}, text, false
+	}
+	at, err := time.Parse(RecordTimeLayout, text[:i])
+	if err != nil {
+		return time.Time{}, text, false
+	}
+	return at, text[i+1:], true
+}
+
+// record is one line of a recording.
+type record struct {
+	at   time.Time
+	line string
+}
+
+// readRecords reads a recording. Lines without a receive time, as in a plain tegrastats logfile,
+// are placed interval after the line before them.
+func readRecords(r io.Reader, interval time.Duration) ([]record, error) {
+	var records []record
+	var last time.Time
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rec := record{at: last.Add(interval), line: text}
+		if at, line, ok := ParseRecord(text); ok {
+			rec = record{at: at, line: line}
+		}
+		records = append(records, rec)
+		last = rec.at
+	}
+	return records, scanner.Err()
+}
+
+// Replay plays a recording back as a Source, at real time or Speed times faster.
+// The embedded latestSample provides Latest, Subscribe and the last sample age.
+type Replay struct {
+	Path string
+	// Speed scales the pace of the recording, 1 is real time and 10 ten times faster.
+	Speed float64
+	// Loop starts over at the end of the recording instead of keeping its last sample.
+	Loop bool
+	// Interval in milliseconds spaces the lines of a recording that carry no receive time.
+	Interval int
+
+	latestSample
+	records []record
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewReplay(path string, speed float64, loop bool, interval int) *Replay {
+	return &Replay{Path: path, Speed: speed, Loop: loop, Interval: interval}
+}
+
+// Start
+// read the recording, serve its first sample and play the rest in the background
+func (r *Replay) Start() error {
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	interval := time.Duration(r.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	r.records, err = readRecords(file, interval)
+	if err != nil {
+		return fmt.Errorf("read recording %s: %s", r.Path, err)
+	}
+	if len(r.records) == 0 {
+		return fmt.Errorf("recording %s is empty", r.Path)
+	}
+	if r.Speed <= 0 {
+		r.Speed = 1
+	}
+	log.Printf("replay %d samples of %s at %gx", len(r.records), r.Path, r.Speed)
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	r.play(r.records[0])
+	go r.run()
+	return nil
+}
+
+func (r *Replay) run() {
+	defer close(r.done)
+	for {
+		for i := 1; i < len(r.records); i++ {
+			if !r.wait(r.records[i].at.Sub(r.records[i-1].at)) {
+				return
+			}
+			r.play(r.records[i])
+		}
+		if !r.Loop {
+			return
+		}
+		// start over one gap after the last record
+		first, last := r.records[0].at, r.records[len(r.records)-1].at
+		gap := time.Second
+		if len(r.records) > 1 {
+			gap = last.Sub(first) / time.Duration(len(r.records)-1)
+		}
+		if !r.wait(gap) {
+			return
+		}
+		r.play(r.records[0])
+	}
+}
+
+// wait sleeps for d of recording time and reports whether the replay is still running.
+func (r *Replay) wait(d time.Duration) bool {
+	if d < 0 {
+		d = 0
+	}
+	select {
+	case <-time.After(time.Duration(float64(d) / r.Speed)):
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+func (r *Replay) play(rec record) {
+	sample, err := tegrastats.Parse(rec.line)
+	if err != nil {
+		log.Debugf("parse tegrastats line: %s", err)
+	}
+	// a replayed sample is as old as its playback, not as the time tegrastats printed,
+	// but its values were measured on the clock of the recording
+	sample.TimePresent = false
+	sample.Recorded = rec.at
+	r.store(sample)
+}
+
+// Stop
+// stop the replay
+func (r *Replay) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
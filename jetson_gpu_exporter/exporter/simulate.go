@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/simulator"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// ModeSimulate generates tegrastats lines for a board without a Jetson, selected with --source=simulate:<board>.
+const ModeSimulate = "simulate"
+
+// Simulator is a Source producing the tegrastats lines of a simulated board every Interval milliseconds.
+// The lines go through the same parser as those of a real tegrastats. The embedded latestSample
+// provides Latest, Subscribe and the last sample age.
+type Simulator struct {
+	Interval int
+	// Board is one of simulator.BoardNames and Pattern one of simulator.PatternNames.
+	Board   string
+	Pattern string
+	Seed    int64
+
+	latestSample
+	generator *simulator.Generator
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewSimulator(interval int, board, pattern string, seed int64) *Simulator {
+	return &Simulator{Interval: interval, Board: board, Pattern: pattern, Seed: seed}
+}
+
+// Start
+// generate one line and then every Interval milliseconds in the background
+func (s *Simulator) Start() error {
+	board, ok := simulator.Boards[s.Board]
+	if !ok {
+		return fmt.Errorf("unknown board %q, want one of %v", s.Board, simulator.BoardNames())
+	}
+	pattern, ok := simulator.Patterns[s.Pattern]
+	if !ok {
+		return fmt.Errorf("unknown load pattern %q, want one of %v", s.Pattern, simulator.PatternNames())
+	}
+	interval := time.Duration(s.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	log.Printf("simulate tegrastats of a %s running the %s load pattern", board.Name, s.Pattern)
+	s.generator = simulator.NewGenerator(board, pattern, s.Seed, time.Now())
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.generate(time.Now())
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.generate(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Simulator) generate(now time.Time) {
+	sample, err := tegrastats.Parse(s.generator.Line(now))
+	if err != nil {
+		log.Debugf("parse tegrastats line: %s", err)
+	}
+	s.store(sample)
+}
+
+// Stop
+// stop generating lines
+func (s *Simulator) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
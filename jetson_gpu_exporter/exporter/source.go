@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source supplies the exporter with parsed tegrastats samples.
+type Source interface {
+	// Start begins producing samples.
+	Start() error
+	// Stop releases everything Start acquired.
+	Stop()
+	// Latest returns the most recent sample, or nil when none has been seen yet.
+	// The returned sample is never modified afterwards.
+	Latest() *tegrastats.Sample
+	// Subscribe calls fn with every sample the source produces from now on, in order.
+	// fn runs on the goroutine reading the source and must not block.
+	Subscribe(fn func(*tegrastats.Sample))
+}
+
+// snapshot is a sample together with the time it was received.
+type snapshot struct {
+	sample *tegrastats.Sample
+	at     time.Time
+}
+
+// latestSample holds the newest snapshot of a source. Readers and the writer
+// never block each other: a new snapshot replaces the old one atomically.
+type latestSample struct {
+	v atomic.Value
+
+	mu          sync.Mutex
+	subscribers []func(*tegrastats.Sample)
+}
+
+// store publishes sample; a sample without a printed timestamp is stamped with its receive time.
+func (l *latestSample) store(sample *tegrastats.Sample) {
+	now := time.Now()
+	if !sample.TimePresent {
+		sample.Time = now
+	}
+	l.v.Store(&snapshot{sample: sample, at: now})
+	l.mu.Lock()
+	subscribers := l.subscribers
+	l.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(sample)
+	}
+}
+
+// load returns the newest snapshot, or an empty one when nothing was stored yet.
+func (l *latestSample) load() *snapshot {
+	if s, ok := l.v.Load().(*snapshot); ok {
+		return s
+	}
+	return &snapshot{}
+}
+
+// Latest implements Source for the sources embedding a latestSample.
+func (l *latestSample) Latest() *tegrastats.Sample {
+	return l.load().sample
+}
+
+// Subscribe implements Source for the sources embedding a latestSample.
+func (l *latestSample) Subscribe(fn func(*tegrastats.Sample)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// copy on write, store may be ranging over the old slice
+	l.subscribers = append(l.subscribers[:len(l.subscribers):len(l.subscribers)], fn)
+}
+
+// Describe implements prometheus.Collector for the age of the last sample.
+func (l *latestSample) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSampleAgeDesc
+}
+
+// Collect implements prometheus.Collector for the age of the last sample.
+func (l *latestSample) Collect(ch chan<- prometheus.Metric) {
+	if last := l.load().at; !last.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastSampleAgeDesc, prometheus.GaugeValue, time.Since(last).Seconds())
+	}
+}
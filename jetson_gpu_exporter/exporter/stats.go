@@ -0,0 +1,197 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultStatsWindow matches the default Prometheus scrape interval.
+const defaultStatsWindow = 15 * time.Second
+
+var (
+	ratioBuckets       = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+	powerBuckets       = prometheus.ExponentialBuckets(0.25, 2, 9)
+	temperatureBuckets = prometheus.LinearBuckets(30, 10, 8)
+)
+
+// statsFamily is the histogram and the windowed min, max and average of one per-sample value,
+// e.g. the load of every CPU core.
+type statsFamily struct {
+	histDesc *prometheus.Desc
+	minDesc  *prometheus.Desc
+	maxDesc  *prometheus.Desc
+	avgDesc  *prometheus.Desc
+	buckets  []float64
+	series   map[string]*distribution
+}
+
+func newStatsFamily(name, unit, what string, buckets []float64, labels ...string) *statsFamily {
+	return &statsFamily{
+		histDesc: newDesc(name+"_sampled_"+unit, "Distribution of every sampled "+what+".", labels...),
+		minDesc:  newDesc(name+"_min_"+unit, "Minimum "+what+" over the samples of the stats window.", labels...),
+		maxDesc:  newDesc(name+"_max_"+unit, "Maximum "+what+" over the samples of the stats window.", labels...),
+		avgDesc:  newDesc(name+"_avg_"+unit, "Average "+what+" over the samples of the stats window.", labels...),
+		buckets:  buckets,
+		series:   make(map[string]*distribution),
+	}
+}
+
+// distribution accumulates the samples of one series.
+type distribution struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	// window holds the samples of the last stats window, oldest first.
+	window []point
+}
+
+type point struct {
+	at    time.Time
+	value float64
+}
+
+func (f *statsFamily) observe(label string, value float64, at time.Time) {
+	d, ok := f.series[label]
+	if !ok {
+		d = &distribution{counts: make([]uint64, len(f.buckets))}
+		f.series[label] = d
+	}
+	for i, bound := range f.buckets {
+		if value <= bound {
+			d.counts[i]++
+		}
+	}
+	d.count++
+	d.sum += value
+	d.window = append(d.window, point{at: at, value: value})
+}
+
+func (f *statsFamily) collect(ch chan<- prometheus.Metric, since time.Time) {
+	for label, d := range f.series {
+		var labels []string
+		if label != "" {
+			labels = []string{label}
+		}
+		buckets := make(map[float64]uint64, len(f.buckets))
+		for i, bound := range f.buckets {
+			buckets[bound] = d.counts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(f.histDesc, d.count, d.sum, buckets, labels...)
+
+		d.prune(since)
+		if len(d.window) == 0 {
+			continue
+		}
+		min, max, sum := d.window[0].value, d.window[0].value, 0.0
+		for _, p := range d.window {
+			if p.value < min {
+				min = p.value
+			}
+			if p.value > max {
+				max = p.value
+			}
+			sum += p.value
+		}
+		sendGauge(ch, f.minDesc, min, labels...)
+		sendGauge(ch, f.maxDesc, max, labels...)
+		sendGauge(ch, f.avgDesc, sum/float64(len(d.window)), labels...)
+	}
+}
+
+// prune drops the samples taken before since.
+func (d *distribution) prune(since time.Time) {
+	i := 0
+	for i < len(d.window) && d.window[i].at.Before(since) {
+		i++
+	}
+	d.window = append(d.window[:0], d.window[i:]...)
+}
+
+// statsRecorder sees every sample of a source, so bursts shorter than the scrape interval
+// still show up in the histograms and in the min/max/avg of the stats window.
+// The window slides with time rather than resetting on scrape, so every Prometheus
+// server scraping the exporter sees the same values.
+type statsRecorder struct {
+	window time.Duration
+	// now is the clock the window ends at, the sample time when backfilling old logs.
+	now func() time.Time
+
+	mu   sync.Mutex
+	gpu  *statsFamily
+	cpu  *statsFamily
+	rail *statsFamily
+	temp *statsFamily
+}
+
+func newStatsRecorder(window time.Duration) *statsRecorder {
+	if window <= 0 {
+		window = defaultStatsWindow
+	}
+	return &statsRecorder{
+		window: window,
+		now:    time.Now,
+		gpu:    newStatsFamily("gpu_utilization", "ratio", "GPU (GR3D) load ratio", ratioBuckets),
+		cpu:    newStatsFamily("cpu_utilization", "ratio", "CPU core load ratio", ratioBuckets, "cpu"),
+		rail:   newStatsFamily("rail_power", "watts", "rail power in watts", powerBuckets, "rail"),
+		temp:   newStatsFamily("temperature", "celsius", "thermal zone temperature in degrees celsius", temperatureBuckets, "zone"),
+	}
+}
+
+func (r *statsRecorder) observe(sample *tegrastats.Sample) {
+	r.observeAt(sample, time.Now())
+}
+
+func (r *statsRecorder) observeAt(sample *tegrastats.Sample, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gpu, ok := engines(sample)["GR3D"]; ok && gpu.UtilizationPresent {
+		r.gpu.observe("", gpu.UtilizationPercent*percent, at)
+	}
+	for _, core := range sample.CPU.Cores {
+		if core.Online {
+			r.cpu.observe(strconv.Itoa(core.Index), core.LoadPercent*percent, at)
+		}
+	}
+	for name, rail := range sample.Rails {
+		r.rail.observe(name, rail.CurrentMilliwatts*milliwatts, at)
+	}
+	for name, temp := range sample.Temps {
+		r.temp.observe(name, temp.Celsius, at)
+	}
+	// keep the windows bounded even when nobody scrapes
+	since := at.Add(-r.window)
+	for _, f := range []*statsFamily{r.gpu, r.cpu, r.rail, r.temp} {
+		for _, d := range f.series {
+			if len(d.window) > 0 && d.window[0].at.Before(since) {
+				d.prune(since)
+			}
+		}
+	}
+}
+
+// collect sends the histograms and window statistics of f, one of the families of r.
+func (r *statsRecorder) collect(ch chan<- prometheus.Metric, f *statsFamily) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.collect(ch, r.now().Add(-r.window))
+}
+
+// statsCollector adds the sampled statistics of one family to the metrics of a collector.
+type statsCollector struct {
+	collector
+	stats  *statsRecorder
+	family *statsFamily
+}
+
+func withStats(c collector, stats *statsRecorder, family *statsFamily) collector {
+	return &statsCollector{collector: c, stats: stats, family: family}
+}
+
+func (c *statsCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	err := c.collector.Update(sample, ch)
+	c.stats.collect(ch, c.family)
+	return err
+}
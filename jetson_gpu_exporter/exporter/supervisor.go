@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	// stopTimeout is how long stop waits after SIGTERM before it sends SIGKILL.
+	stopTimeout = 5 * time.Second
+)
+
+// supervisor keeps a child process running and restarts it with exponential backoff when it exits.
+type supervisor struct {
+	path string
+	args []string
+	// stdout consumes the child's stdout until it is closed; nil discards it.
+	stdout func(io.Reader)
+
+	mu       sync.Mutex
+	pid      int
+	up       bool
+	restarts int
+	stopped  bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+func newSupervisor(path string, args []string, stdout func(io.Reader)) *supervisor {
+	return &supervisor{
+		path:   path,
+		args:   args,
+		stdout: stdout,
+		wake:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// start launches the child once and keeps supervising it in the background.
+// Only the first launch error is returned, later ones are retried.
+func (s *supervisor) start() error {
+	cmd, stdout, err := s.launch()
+	if err != nil {
+		close(s.done)
+		return err
+	}
+	go s.run(cmd, stdout)
+	return nil
+}
+
+func (s *supervisor) launch() (*exec.Cmd, io.Reader, error) {
+	cmd := exec.Command(s.path, s.args...)
+	var stdout io.Reader
+	if s.stdout != nil {
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		stdout = pipe
+	}
+	log.Println("exec cmd " + cmd.String())
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	s.pid = cmd.Process.Pid
+	s.up = true
+	if s.stopped {
+		// stop raced with a restart, the run loop reaps this child
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	s.mu.Unlock()
+	return cmd, stdout, nil
+}
+
+func (s *supervisor) run(cmd *exec.Cmd, stdout io.Reader) {
+	defer close(s.done)
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		if stdout != nil {
+			s.stdout(stdout)
+		}
+		err := cmd.Wait()
+		s.mu.Lock()
+		s.up = false
+		stopped := s.stopped
+		s.mu.Unlock()
+		if stopped {
+			return
+		}
+		if time.Since(started) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		log.Warnf("%s (pid %d) exited: %v, restarting in %s", s.path, cmd.Process.Pid, err, backoff)
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-s.wake:
+				return
+			}
+			backoff *= 2
+			if backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+			s.mu.Lock()
+			s.restarts++
+			s.mu.Unlock()
+			cmd, stdout, err = s.launch()
+			if err == nil {
+				break
+			}
+			log.Errorf("restart %s failed: %s, retrying in %s", s.path, err, backoff)
+		}
+	}
+}
+
+// stop terminates the child by PID and stops restarting it.
+// Other tegrastats instances on the board are left alone.
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	pid, up := s.pid, s.up
+	s.mu.Unlock()
+	close(s.wake)
+	if !up {
+		<-s.done
+		return
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(stopTimeout):
+		log.Warnf("%s (pid %d) did not exit within %s, killing it", s.path, pid, stopTimeout)
+		syscall.Kill(pid, syscall.SIGKILL)
+		<-s.done
+	}
+}
+
+// status reports the current PID, whether the child is running and how often it was restarted.
+func (s *supervisor) status() (pid int, up bool, restarts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pid, s.up, s.restarts
+}
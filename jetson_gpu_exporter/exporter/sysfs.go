@@ -0,0 +1,373 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModeSysfs reads sysfs and procfs directly and does not need tegrastats at all.
+const ModeSysfs = "sysfs"
+
+var (
+	// gpuLoadPaths hold the GPU load in per mille on the different board generations.
+	gpuLoadPaths = []string{
+		"devices/gpu.0/load",
+		"devices/platform/gpu.0/load",
+		"devices/platform/17000000.ga10b/load",
+		"devices/17000000.gv11b/load",
+		"devices/17000000.gp10b/load",
+		"devices/57000000.gpu/load",
+	}
+	// emcRatePaths hold the EMC clock in Hz; they live in debugfs and usually need root.
+	emcRatePaths = []string{
+		"kernel/debug/bpmp/debug/clk/emc/rate",
+		"kernel/debug/clk/emc/clk_rate",
+	}
+	gpuDevfreqRegexp = regexp.MustCompile(`\.(gpu|gm20b|gp10b|gv11b|ga10b)$`)
+	cpuDirRegexp     = regexp.MustCompile(`^cpu(\d+)$`)
+)
+
+// Sysfs builds samples from /sys and /proc every Interval milliseconds,
+// so boards and containers without tegrastats still get the same metrics.
+// The embedded latestSample provides Latest, Subscribe and the last sample age.
+type Sysfs struct {
+	Interval int
+	Paths    Paths
+
+	latestSample
+	cpuTimes map[int]cpuTimes
+	railAvg  map[string]*railAverage
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type cpuTimes struct {
+	total uint64
+	idle  uint64
+}
+
+// railAverage keeps a running average since start, like tegrastats does.
+type railAverage struct {
+	sum   float64
+	count int
+}
+
+func NewSysfs(interval int, paths Paths) *Sysfs {
+	return &Sysfs{
+		Interval: interval,
+		Paths:    paths,
+		railAvg:  make(map[string]*railAverage),
+	}
+}
+
+// Start
+// read sysfs once and then every Interval milliseconds in the background
+func (s *Sysfs) Start() error {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	interval := time.Duration(s.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	s.update()
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.update()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop
+// stop reading sysfs
+func (s *Sysfs) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sysfs) update() {
+	sample := &tegrastats.Sample{}
+	if err := readMeminfo(s.Paths, sample); err != nil {
+		log.Debugf("read meminfo: %s", err)
+	}
+	s.readCPU(sample)
+	readGPU(s.Paths, sample)
+	readEMC(s.Paths, sample)
+	readThermal(s.Paths, sample)
+	s.readRails(sample)
+	s.store(sample)
+}
+
+// readMeminfo fills RAM and SWAP the way tegrastats computes them from /proc/meminfo
+func readMeminfo(paths Paths, sample *tegrastats.Sample) error {
+	f, err := os.Open(paths.proc("meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			value <<= 10
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if total, ok := info["MemTotal"]; ok {
+		sample.RAM = tegrastats.Memory{
+			Present:    true,
+			TotalBytes: total,
+			UsedBytes:  total - info["MemFree"] - info["Buffers"] - info["Cached"],
+		}
+	}
+	if total, ok := info["SwapTotal"]; ok {
+		sample.Swap = tegrastats.Memory{
+			Present:     true,
+			TotalBytes:  total,
+			UsedBytes:   total - info["SwapFree"],
+			CachedBytes: info["SwapCached"],
+		}
+	}
+	return nil
+}
+
+// readCPU fills the cores from cpufreq and their load since the previous update from /proc/stat
+func (s *Sysfs) readCPU(sample *tegrastats.Sample) {
+	dirs, err := os.ReadDir(s.Paths.sys("devices/system/cpu"))
+	if err != nil {
+		log.Debugf("read cpus: %s", err)
+		return
+	}
+	times := readCPUTimes(s.Paths)
+	cpu := tegrastats.CPU{Present: true}
+	for _, dir := range dirs {
+		params := cpuDirRegexp.FindStringSubmatch(dir.Name())
+		if params == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(params[1])
+		core := tegrastats.Core{Index: index, Online: true}
+		cpuDir := s.Paths.sys("devices/system/cpu", dir.Name())
+		// cpu0 usually cannot be taken offline and has no online file
+		if online, err := readInt(filepath.Join(cpuDir, "online")); err == nil && online == 0 {
+			core.Online = false
+		}
+		if core.Online {
+			if freq, err := readInt(filepath.Join(cpuDir, "cpufreq/scaling_cur_freq")); err == nil {
+				core.FrequencyPresent = true
+				core.FrequencyMHz = float64(freq) / 1000
+			}
+			cur, ok := times[index]
+			prev, seen := s.cpuTimes[index]
+			if ok && seen && cur.total > prev.total {
+				busy := (cur.total - prev.total) - (cur.idle - prev.idle)
+				core.LoadPercent = float64(busy) * 100 / float64(cur.total-prev.total)
+			}
+		}
+		cpu.Cores = append(cpu.Cores, core)
+	}
+	sort.Slice(cpu.Cores, func(i, j int) bool { return cpu.Cores[i].Index < cpu.Cores[j].Index })
+	s.cpuTimes = times
+	if len(cpu.Cores) > 0 {
+		sample.CPU = cpu
+	}
+}
+
+// readCPUTimes returns the total and idle jiffies of every core in /proc/stat
+func readCPUTimes(paths Paths) map[int]cpuTimes {
+	times := make(map[int]cpuTimes)
+	f, err := os.Open(paths.proc("stat"))
+	if err != nil {
+		return times
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			continue
+		}
+		var t cpuTimes
+		for i, field := range fields[1:] {
+			v, _ := strconv.ParseUint(field, 10, 64)
+			t.total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+		times[index] = t
+	}
+	return times
+}
+
+// readGPU fills GR3D_FREQ from the GPU load and devfreq
+func readGPU(paths Paths, sample *tegrastats.Sample) {
+	engine := tegrastats.Engine{Name: "GR3D_FREQ", Online: true}
+	for _, path := range gpuLoadPaths {
+		if load, err := readInt(paths.sys(path)); err == nil {
+			engine.UtilizationPresent = true
+			engine.UtilizationPercent = float64(load) / 10
+			break
+		}
+	}
+	devfreqs, _ := filepath.Glob(paths.sys("class/devfreq/*"))
+	for _, devfreq := range devfreqs {
+		if !gpuDevfreqRegexp.MatchString(devfreq) {
+			continue
+		}
+		if freq, err := readInt(filepath.Join(devfreq, "cur_freq")); err == nil {
+			engine.FrequencyPresent = true
+			engine.FrequencyMHz = float64(freq) / 1e6
+			break
+		}
+	}
+	if engine.UtilizationPresent || engine.FrequencyPresent {
+		setEngine(sample, engine)
+	}
+}
+
+// readEMC fills EMC_FREQ with the memory controller clock when debugfs is readable
+func readEMC(paths Paths, sample *tegrastats.Sample) {
+	for _, path := range emcRatePaths {
+		if rate, err := readInt(paths.sys(path)); err == nil {
+			setEngine(sample, tegrastats.Engine{
+				Name:             "EMC_FREQ",
+				Online:           true,
+				FrequencyPresent: true,
+				FrequencyMHz:     float64(rate) / 1e6,
+			})
+			return
+		}
+	}
+}
+
+func setEngine(sample *tegrastats.Sample, engine tegrastats.Engine) {
+	if sample.Engines == nil {
+		sample.Engines = make(map[string]tegrastats.Engine)
+	}
+	sample.Engines[engine.Name] = engine
+}
+
+// readThermal fills the temperatures of /sys/class/thermal, named like tegrastats names them
+func readThermal(paths Paths, sample *tegrastats.Sample) {
+	zones, _ := filepath.Glob(paths.sys("class/thermal/thermal_zone*"))
+	for _, zone := range zones {
+		name, err := readString(filepath.Join(zone, "type"))
+		if err != nil {
+			continue
+		}
+		temp, err := readInt(filepath.Join(zone, "temp"))
+		if err != nil {
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "-thermal"), "-therm")
+		if sample.Temps == nil {
+			sample.Temps = make(map[string]tegrastats.Temperature)
+		}
+		sample.Temps[name] = tegrastats.Temperature{Name: name, Celsius: float64(temp) / 1000}
+	}
+}
+
+// readRails fills the power rails of the INA3221 monitors, both the hwmon driver
+// of JetPack 5 and later and the ina3221x iio driver of older releases
+func (s *Sysfs) readRails(sample *tegrastats.Sample) {
+	powers := make(map[string]float64)
+	hwmons, _ := filepath.Glob(s.Paths.sys("class/hwmon/hwmon*"))
+	for _, hwmon := range hwmons {
+		if name, _ := readString(filepath.Join(hwmon, "name")); name != "ina3221" {
+			continue
+		}
+		for channel := 1; channel <= 3; channel++ {
+			label, err := readString(filepath.Join(hwmon, fmt.Sprintf("in%d_label", channel)))
+			if err != nil || label == "NC" {
+				continue
+			}
+			millivolts, err1 := readInt(filepath.Join(hwmon, fmt.Sprintf("in%d_input", channel)))
+			milliamps, err2 := readInt(filepath.Join(hwmon, fmt.Sprintf("curr%d_input", channel)))
+			if err1 == nil && err2 == nil {
+				powers[label] = float64(millivolts) * float64(milliamps) / 1000
+			}
+		}
+	}
+	iios, _ := filepath.Glob(s.Paths.sys("bus/i2c/drivers/ina3221x/*/iio:device*"))
+	for _, iio := range iios {
+		for channel := 0; channel < 3; channel++ {
+			label, err := readString(filepath.Join(iio, fmt.Sprintf("rail_name_%d", channel)))
+			if err != nil {
+				continue
+			}
+			if milliwatts, err := readInt(filepath.Join(iio, fmt.Sprintf("in_power%d_input", channel))); err == nil {
+				powers[label] = float64(milliwatts)
+			}
+		}
+	}
+	for name, power := range powers {
+		avg, ok := s.railAvg[name]
+		if !ok {
+			avg = &railAverage{}
+			s.railAvg[name] = avg
+		}
+		avg.sum += power
+		avg.count++
+		if sample.Rails == nil {
+			sample.Rails = make(map[string]tegrastats.Rail)
+		}
+		sample.Rails[name] = tegrastats.Rail{
+			Name:              name,
+			CurrentMilliwatts: power,
+			AverageMilliwatts: avg.sum / float64(avg.count),
+		}
+	}
+}
+
+func readString(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func readInt(path string) (int64, error) {
+	s, err := readString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
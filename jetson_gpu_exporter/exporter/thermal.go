@@ -0,0 +1,31 @@
+package exporter
+
+import (
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("thermal", true, newThermalCollector)
+}
+
+var temperatureDesc = newDesc("temperature_celsius", "Temperature of a thermal zone in degrees celsius.", "zone")
+
+type thermalCollector struct{}
+
+func newThermalCollector(opts CollectorOptions) collector {
+	if opts.LegacyNames {
+		return newLegacyThermalCollector()
+	}
+	return withStats(&thermalCollector{}, opts.stats, opts.stats.temp)
+}
+
+func (c *thermalCollector) Update(sample *tegrastats.Sample, ch chan<- prometheus.Metric) error {
+	if len(sample.Temps) == 0 {
+		return errNoData
+	}
+	for name, temp := range sample.Temps {
+		sendGauge(ch, temperatureDesc, temp.Celsius, name)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package simulator
+
+import "sort"
+
+// Board describes what tegrastats prints on one Jetson module and how its power and
+// temperatures respond to load. The values follow real tegrastats output of each module.
+type Board struct {
+	Name string
+	// Cores is the number of CPU cores, CPUMinMHz and CPUMaxMHz their DVFS range.
+	Cores     int
+	CPUMinMHz float64
+	CPUMaxMHz float64
+	// GPCs is the number of GPU clusters on boards that print "GR3D_FREQ X%@[Y0,Y1]",
+	// 0 on boards that print a single clock.
+	GPCs      int
+	GPUMinMHz float64
+	GPUMaxMHz float64
+	EMCMHz    float64
+
+	RAMTotalMB  uint64
+	RAMIdleMB   uint64
+	SwapTotalMB uint64
+	// IRAM and MTS are only printed by Tegra X1 based boards.
+	IRAM bool
+	MTS  bool
+	// Timestamp prints the "MM-DD-YYYY HH:MM:SS" prefix of JetPack 4.6 and later.
+	Timestamp bool
+	// Milliwatts prints rails as "NAME XmW/YmW" like JetPack 5 and later.
+	Milliwatts bool
+
+	// Engines are printed after GR3D_FREQ in this order, e.g. NVENC or VIC_FREQ.
+	Engines []string
+	Rails   []Rail
+	// Temps are the thermal zones in print order.
+	Temps []Zone
+}
+
+// Rail is a power rail whose draw is IdleMW plus CPUMW and GPUMW scaled by the load.
+type Rail struct {
+	Name   string
+	IdleMW float64
+	CPUMW  float64
+	GPUMW  float64
+}
+
+// Zone is a thermal zone which settles at IdleC when idle and RiseC above it under full load.
+// Sensors a board reports as absent, like CV1@-256C on AGX Orin, have a RiseC of 0.
+type Zone struct {
+	Name  string
+	IdleC float64
+	RiseC float64
+}
+
+// Boards are the simulated modules, keyed by the name --source=simulate:<board> takes.
+var Boards = map[string]Board{
+	"nano": {
+		Name: "Jetson Nano", Cores: 4, CPUMinMHz: 102, CPUMaxMHz: 1479,
+		GPUMinMHz: 76, GPUMaxMHz: 921, EMCMHz: 1600,
+		RAMTotalMB: 3964, RAMIdleMB: 1900, SwapTotalMB: 1982, IRAM: true, MTS: true,
+		Rails: []Rail{
+			{Name: "POM_5V_IN", IdleMW: 1900, CPUMW: 2200, GPUMW: 3400},
+			{Name: "POM_5V_GPU", IdleMW: 0, GPUMW: 3000},
+			{Name: "POM_5V_CPU", IdleMW: 350, CPUMW: 1900},
+		},
+		Temps: []Zone{{"PLL", 33, 12}, {"CPU", 36, 18}, {"PMIC", 100, 0}, {"GPU", 34, 20}, {"AO", 41.5, 10}, {"thermal", 35, 18}},
+	},
+	"tx2": {
+		Name: "Jetson TX2", Cores: 6, CPUMinMHz: 345, CPUMaxMHz: 2035,
+		GPUMinMHz: 114, GPUMaxMHz: 1300, EMCMHz: 1866,
+		RAMTotalMB: 7851, RAMIdleMB: 1550, SwapTotalMB: 3925,
+		Engines: []string{"APE"},
+		Rails: []Rail{
+			{Name: "VDD_SYS_GPU", IdleMW: 150, GPUMW: 4800},
+			{Name: "VDD_SYS_SOC", IdleMW: 680, CPUMW: 200, GPUMW: 600},
+			{Name: "VDD_4V0_WIFI", IdleMW: 0},
+			{Name: "VDD_IN", IdleMW: 2200, CPUMW: 3000, GPUMW: 6200},
+			{Name: "VDD_SYS_CPU", IdleMW: 230, CPUMW: 2600},
+			{Name: "VDD_SYS_DDR", IdleMW: 300, CPUMW: 300, GPUMW: 800},
+		},
+		Temps: []Zone{{"PLL", 40, 14}, {"MCPU", 40, 20}, {"PMIC", 100, 0}, {"Tboard", 37, 6}, {"GPU", 38, 24}, {"BCPU", 40, 20}, {"thermal", 39.1, 20}, {"Tdiode", 37.5, 10}},
+	},
+	"xavier-nx": {
+		Name: "Jetson Xavier NX", Cores: 6, CPUMinMHz: 115, CPUMaxMHz: 1907,
+		GPUMinMHz: 114, GPUMaxMHz: 1109, EMCMHz: 1600,
+		RAMTotalMB: 7763, RAMIdleMB: 1700, SwapTotalMB: 3882, Timestamp: true,
+		Rails: []Rail{
+			{Name: "VDD_IN", IdleMW: 3750, CPUMW: 3000, GPUMW: 7000},
+			{Name: "VDD_CPU_GPU_CV", IdleMW: 200, CPUMW: 2400, GPUMW: 5600},
+			{Name: "VDD_SOC", IdleMW: 1060, CPUMW: 300, GPUMW: 900},
+		},
+		Temps: []Zone{{"AO", 35.5, 12}, {"GPU", 35.5, 24}, {"PMIC", 100, 0}, {"AUX", 35.5, 12}, {"CPU", 36, 22}, {"thermal", 35.65, 22}},
+	},
+	"agx-xavier": {
+		Name: "Jetson AGX Xavier", Cores: 8, CPUMinMHz: 115, CPUMaxMHz: 2265,
+		GPUMinMHz: 114, GPUMaxMHz: 1377, EMCMHz: 2133,
+		RAMTotalMB: 31919, RAMIdleMB: 3200, SwapTotalMB: 15959, MTS: true,
+		Engines: []string{"NVENC", "NVDEC", "NVJPG", "VIC_FREQ", "APE"},
+		Rails: []Rail{
+			{Name: "GPU", IdleMW: 0, GPUMW: 12000},
+			{Name: "CPU", IdleMW: 310, CPUMW: 5500},
+			{Name: "SOC", IdleMW: 1550, CPUMW: 500, GPUMW: 1800},
+			{Name: "CV", IdleMW: 0},
+			{Name: "VDDRQ", IdleMW: 310, CPUMW: 400, GPUMW: 1200},
+			{Name: "SYS5V", IdleMW: 2100, CPUMW: 900, GPUMW: 2200},
+		},
+		Temps: []Zone{{"AO", 32, 12}, {"GPU", 32.5, 28}, {"Tdiode", 34, 12}, {"PMIC", 100, 0}, {"AUX", 31.5, 12}, {"CPU", 33.5, 24}, {"thermal", 32.6, 24}, {"Tboard", 32, 6}},
+	},
+	"orin-nano": {
+		Name: "Jetson Orin Nano", Cores: 6, CPUMinMHz: 115, CPUMaxMHz: 1510,
+		GPCs: 1, GPUMinMHz: 305, GPUMaxMHz: 625, EMCMHz: 2133,
+		RAMTotalMB: 7620, RAMIdleMB: 1900, SwapTotalMB: 3810, Timestamp: true, Milliwatts: true,
+		Rails: []Rail{
+			{Name: "VDD_IN", IdleMW: 4700, CPUMW: 2500, GPUMW: 5000},
+			{Name: "VDD_CPU_GPU_CV", IdleMW: 560, CPUMW: 1900, GPUMW: 3800},
+			{Name: "VDD_SOC", IdleMW: 1400, CPUMW: 300, GPUMW: 700},
+		},
+		Temps: []Zone{{"cpu", 45.3, 18}, {"soc2", 44, 14}, {"soc0", 44.3, 14}, {"gpu", 43.3, 22}, {"tj", 45.3, 24}, {"soc1", 42.8, 14}},
+	},
+	"agx-orin": {
+		Name: "Jetson AGX Orin", Cores: 12, CPUMinMHz: 115, CPUMaxMHz: 2201,
+		GPCs: 2, GPUMinMHz: 305, GPUMaxMHz: 1300, EMCMHz: 3199,
+		RAMTotalMB: 30536, RAMIdleMB: 2850, SwapTotalMB: 15268, Timestamp: true, Milliwatts: true,
+		Engines: []string{"NVENC", "NVDEC", "NVJPG", "NVJPG1", "VIC", "OFA", "NVDLA0", "NVDLA1", "PVA0_FREQ", "APE"},
+		Rails: []Rail{
+			{Name: "VDD_GPU_SOC", IdleMW: 2800, CPUMW: 600, GPUMW: 22000},
+			{Name: "VDD_CPU_CV", IdleMW: 400, CPUMW: 9000, GPUMW: 600},
+			{Name: "VIN_SYS_5V0", IdleMW: 3600, CPUMW: 800, GPUMW: 2000},
+			{Name: "VDDQ_VDD2_1V8AO", IdleMW: 600, CPUMW: 300, GPUMW: 900},
+		},
+		Temps: []Zone{{"CPU", 49, 26}, {"tboard", 37, 6}, {"SOC2", 46.6, 18}, {"tdiode", 38.5, 10}, {"SOC0", 47.3, 18}, {"CV1", -256, 0}, {"GPU", 46.2, 30}, {"tj", 49, 32}, {"SOC1", 46.6, 18}, {"CV2", -256, 0}},
+	},
+}
+
+// BoardNames returns the names of all simulated boards, sorted.
+func BoardNames() []string {
+	names := make([]string, 0, len(Boards))
+	for name := range Boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
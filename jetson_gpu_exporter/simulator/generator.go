@@ -0,0 +1,174 @@
+package simulator
+
+import (
+	"fmt"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// thermalTimeConstant is how fast temperatures follow the load; a soak takes a few minutes to settle.
+const thermalTimeConstant = 90 * time.Second
+
+// Generator writes the tegrastats lines of a simulated board running a load pattern.
+// It is not safe for concurrent use.
+type Generator struct {
+	board   Board
+	pattern Pattern
+	seed    int64
+	rnd     *rand.Rand
+
+	start time.Time
+	last  time.Time
+	// heat is the thermal state from 0 (idle) to 1 (soaked at full load).
+	heat     float64
+	railSum  []float64
+	railRuns int
+}
+
+// NewGenerator returns a Generator whose simulation starts at start.
+func NewGenerator(board Board, pattern Pattern, seed int64, start time.Time) *Generator {
+	return &Generator{
+		board:   board,
+		pattern: pattern,
+		seed:    seed,
+		rnd:     rand.New(rand.NewSource(seed)),
+		start:   start,
+		last:    start,
+		railSum: make([]float64, len(board.Rails)),
+	}
+}
+
+// Line returns the tegrastats line the board prints at at, which must not be before the previous one.
+func (g *Generator) Line(at time.Time) string {
+	load := g.pattern(at.Sub(g.start), g.seed)
+	load.CPU = g.jitter(load.CPU, 0.03)
+	load.GPU = g.jitter(load.GPU, 0.02)
+	g.warm(load, at)
+
+	b := g.board
+	var fields []string
+	if b.Timestamp {
+		fields = append(fields, at.Format(tegrastats.TimeLayout))
+	}
+	ramUsed := b.RAMIdleMB + uint64(float64(b.RAMTotalMB-b.RAMIdleMB)*0.3*math.Max(load.CPU, load.GPU))
+	lfb := (b.RAMTotalMB - ramUsed) / 8 / 4
+	fields = append(fields, fmt.Sprintf("RAM %d/%dMB (lfb %dx4MB)", ramUsed, b.RAMTotalMB, lfb))
+	fields = append(fields, fmt.Sprintf("SWAP 0/%dMB (cached 0MB)", b.SwapTotalMB))
+	if b.IRAM {
+		fields = append(fields, "IRAM 0/252kB(lfb 252kB)")
+	}
+	fields = append(fields, g.cpu(load.CPU))
+	fields = append(fields, fmt.Sprintf("EMC_FREQ %d%%@%.0f", percent(0.1*load.CPU+0.5*load.GPU), b.EMCMHz))
+	fields = append(fields, g.gpu(load.GPU))
+	for _, engine := range b.Engines {
+		fields = append(fields, g.engine(engine, load.GPU))
+	}
+	if b.MTS {
+		fields = append(fields, fmt.Sprintf("MTS fg %d%% bg %d%%", percent(0.05*load.CPU), percent(0.1*load.CPU)))
+	}
+	for _, zone := range b.Temps {
+		fields = append(fields, g.temperature(zone))
+	}
+	for i, rail := range b.Rails {
+		fields = append(fields, g.rail(i, rail, load))
+	}
+	return strings.Join(fields, " ")
+}
+
+// warm moves the thermal state towards the load with a first order lag.
+func (g *Generator) warm(load Load, at time.Time) {
+	elapsed := at.Sub(g.last)
+	g.last = at
+	target := math.Max(load.GPU, load.CPU)
+	g.heat += (target - g.heat) * (1 - math.Exp(-float64(elapsed)/float64(thermalTimeConstant)))
+}
+
+func (g *Generator) cpu(load float64) string {
+	b := g.board
+	cores := make([]string, b.Cores)
+	for i := range cores {
+		// the second half of the cores is hotplugged off while the board idles
+		if i >= (b.Cores+1)/2 && load < 0.2 {
+			cores[i] = "off"
+			continue
+		}
+		freq := b.CPUMinMHz + (b.CPUMaxMHz-b.CPUMinMHz)*math.Min(1, 2*load)
+		cores[i] = fmt.Sprintf("%d%%@%.0f", percent(g.jitter(load, 0.05)), freq)
+	}
+	return "CPU [" + strings.Join(cores, ",") + "]"
+}
+
+func (g *Generator) gpu(load float64) string {
+	b := g.board
+	freq := b.GPUMinMHz
+	if load > 0.01 {
+		freq = b.GPUMaxMHz
+	}
+	if b.GPCs == 0 {
+		return fmt.Sprintf("GR3D_FREQ %d%%@%.0f", percent(load), freq)
+	}
+	gpcs := make([]string, b.GPCs)
+	for i := range gpcs {
+		gpcs[i] = fmt.Sprintf("%.0f", freq)
+	}
+	return fmt.Sprintf("GR3D_FREQ %d%%@[%s]", percent(load), strings.Join(gpcs, ","))
+}
+
+// engine prints the codecs and accelerators as busy while the GPU is, as in a video analytics pipeline.
+func (g *Generator) engine(name string, load float64) string {
+	if name == "APE" {
+		return "APE 150"
+	}
+	if load < 0.1 {
+		return name + " off"
+	}
+	if strings.HasSuffix(name, "_FREQ") || name == "VIC" {
+		return fmt.Sprintf("%s %d%%@%.0f", name, percent(0.3*load), g.board.GPUMaxMHz/2)
+	}
+	return fmt.Sprintf("%s %.0f", name, g.board.GPUMaxMHz)
+}
+
+func (g *Generator) temperature(zone Zone) string {
+	celsius := zone.IdleC + zone.RiseC*g.heat
+	if zone.RiseC > 0 {
+		celsius += g.rnd.Float64()*0.5 - 0.25
+	}
+	return fmt.Sprintf("%s@%sC", zone.Name, trimFloat(celsius))
+}
+
+// rail prints the instantaneous power and the running average tegrastats keeps since it started.
+func (g *Generator) rail(i int, rail Rail, load Load) string {
+	mw := rail.IdleMW + rail.CPUMW*load.CPU + rail.GPUMW*load.GPU
+	if mw > 0 {
+		mw = math.Max(0, mw*(1+g.rnd.Float64()*0.04-0.02))
+	}
+	if i == 0 {
+		g.railRuns++
+	}
+	g.railSum[i] += mw
+	avg := g.railSum[i] / float64(g.railRuns)
+	if g.board.Milliwatts {
+		return fmt.Sprintf("%s %.0fmW/%.0fmW", rail.Name, mw, avg)
+	}
+	return fmt.Sprintf("%s %.0f/%.0f", rail.Name, mw, avg)
+}
+
+// jitter adds noise of up to spread to value and keeps it within 0 and 1.
+func (g *Generator) jitter(value, spread float64) float64 {
+	if value == 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, value+(g.rnd.Float64()*2-1)*spread))
+}
+
+func percent(ratio float64) int {
+	return int(math.Round(ratio * 100))
+}
+
+// trimFloat prints a temperature the way tegrastats does, e.g. 35C, 35.5C or 49.062C.
+func trimFloat(v float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", v), "0"), ".")
+}
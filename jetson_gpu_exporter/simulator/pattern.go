@@ -0,0 +1,67 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Load is the CPU and GPU utilisation of the simulated board, from 0 to 1.
+type Load struct {
+	CPU float64
+	GPU float64
+}
+
+// Pattern returns the load elapsed after the simulation started.
+// It is a pure function of elapsed and seed, so a simulation can be reproduced.
+type Pattern func(elapsed time.Duration, seed int64) Load
+
+const (
+	// rampPeriod is how long the ramp pattern takes from idle to full load.
+	rampPeriod = 5 * time.Minute
+	// burstSlot is the period in which the bursty pattern fires at most one GPU burst.
+	burstSlot = 5 * time.Second
+)
+
+// Patterns are the load patterns, keyed by the name --simulate.pattern takes.
+var Patterns = map[string]Pattern{
+	// idle is a board with nothing running but the desktop.
+	"idle": func(time.Duration, int64) Load {
+		return Load{CPU: 0.03, GPU: 0}
+	},
+	// ramp raises CPU and GPU load linearly from idle to full over rampPeriod, then starts over.
+	"ramp": func(elapsed time.Duration, _ int64) Load {
+		f := float64(elapsed%rampPeriod) / float64(rampPeriod)
+		return Load{CPU: 0.03 + 0.9*f, GPU: f}
+	},
+	// soak keeps the GPU saturated and the CPU busy, so temperatures climb to their steady state.
+	"soak": func(time.Duration, int64) Load {
+		return Load{CPU: 0.7, GPU: 1}
+	},
+	// bursty idles with GPU bursts of 0.2s to 2s that a 15s scrape interval would miss.
+	"bursty": func(elapsed time.Duration, seed int64) Load {
+		slot := int64(elapsed / burstSlot)
+		rnd := rand.New(rand.NewSource(seed ^ slot))
+		if rnd.Float64() < 0.4 {
+			return Load{CPU: 0.05}
+		}
+		start := time.Duration(rnd.Int63n(int64(burstSlot / 2)))
+		length := 200*time.Millisecond + time.Duration(rnd.Int63n(int64(1800*time.Millisecond)))
+		offset := elapsed % burstSlot
+		if offset >= start && offset < start+length {
+			return Load{CPU: 0.25, GPU: 0.95 + 0.05*math.Abs(math.Sin(float64(offset)))}
+		}
+		return Load{CPU: 0.05}
+	},
+}
+
+// PatternNames returns the names of all load patterns, sorted.
+func PatternNames() []string {
+	names := make([]string, 0, len(Patterns))
+	for name := range Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,92 @@
+package tegrastats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Field is one named value of a flattened Sample.
+type Field struct {
+	Name  string
+	Value float64
+}
+
+// Flatten turns a sample into named columns for tabular output, e.g. ram_used_bytes,
+// cpu0_load_percent, gr3d_freq_frequency_mhz, vdd_in_current_mw or temp_gpu_celsius.
+// Only the groups present in the sample are returned, in print order, and the
+// entries of maps sorted by name, so the same board always gives the same columns.
+func Flatten(sample *Sample) []Field {
+	var fields []Field
+	add := func(value float64, format string, args ...interface{}) {
+		fields = append(fields, Field{Name: strings.ToLower(fmt.Sprintf(format, args...)), Value: value})
+	}
+	bool01 := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	if m := sample.RAM; m.Present {
+		add(float64(m.UsedBytes), "ram_used_bytes")
+		add(float64(m.TotalBytes), "ram_total_bytes")
+		add(float64(m.LargestFreeBlockBytes), "ram_lfb_bytes")
+		add(float64(m.LargestFreeBlocks), "ram_lfb_blocks")
+	}
+	if m := sample.Swap; m.Present {
+		add(float64(m.UsedBytes), "swap_used_bytes")
+		add(float64(m.TotalBytes), "swap_total_bytes")
+		add(float64(m.CachedBytes), "swap_cached_bytes")
+	}
+	if m := sample.IRAM; m.Present {
+		add(float64(m.UsedBytes), "iram_used_bytes")
+		add(float64(m.TotalBytes), "iram_total_bytes")
+		add(float64(m.LargestFreeBlockBytes), "iram_lfb_bytes")
+	}
+	for _, core := range sample.CPU.Cores {
+		add(bool01(core.Online), "cpu%d_online", core.Index)
+		add(core.LoadPercent, "cpu%d_load_percent", core.Index)
+		add(core.FrequencyMHz, "cpu%d_frequency_mhz", core.Index)
+	}
+	if sample.MTS.Present {
+		add(sample.MTS.ForegroundPercent, "mts_fg_percent")
+		add(sample.MTS.BackgroundPercent, "mts_bg_percent")
+	}
+	var names []string
+	for name := range sample.Engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		engine := sample.Engines[name]
+		add(bool01(engine.Online), "%s_online", name)
+		if engine.UtilizationPresent {
+			add(engine.UtilizationPercent, "%s_utilization_percent", name)
+		}
+		if engine.FrequencyPresent {
+			add(engine.FrequencyMHz, "%s_frequency_mhz", name)
+		}
+		for i, freq := range engine.GPCFrequenciesMHz {
+			add(freq, "%s_gpc%d_frequency_mhz", name, i)
+		}
+	}
+	names = names[:0]
+	for name := range sample.Rails {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(sample.Rails[name].CurrentMilliwatts, "%s_current_mw", name)
+		add(sample.Rails[name].AverageMilliwatts, "%s_average_mw", name)
+	}
+	names = names[:0]
+	for name := range sample.Temps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(sample.Temps[name].Celsius, "temp_%s_celsius", name)
+	}
+	return fields
+}
@@ -0,0 +1,312 @@
+package tegrastats
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the "MM-DD-YYYY HH:MM:SS" prefix recent tegrastats releases print.
+const TimeLayout = "01-02-2006 15:04:05"
+
+var (
+	memoryRegexp      = regexp.MustCompile(`^(\d+)/(\d+)(\w?)B(\(\w+)?$`)
+	lfbBlocksRegexp   = regexp.MustCompile(`^(\d+)x(\d+)(\w?)B\)$`)
+	sizeRegexp        = regexp.MustCompile(`^(\d+)(\w?)B\)$`)
+	cpuRegexp         = regexp.MustCompile(`^\[(.*)\](?:@(\d+))?$`)
+	coreRegexp        = regexp.MustCompile(`^(\d+)%(?:@(\d+))?$`)
+	percentRegexp     = regexp.MustCompile(`^(\d+)%$`)
+	engineRegexp      = regexp.MustCompile(`^(\d+)%(?:@(\d+|\[[0-9,]+\]))?$`)
+	engineFreqRegexp  = regexp.MustCompile(`^@?(\d+)$`)
+	temperatureRegexp = regexp.MustCompile(`^(\w+)@(-?[0-9.]+)C$`)
+	railNameRegexp    = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	railValueRegexp   = regexp.MustCompile(`^(\d+)(?:mW)?/(\d+)(?:mW)?$`)
+)
+
+// engineNames are the hardware engines tegrastats can print, across all board generations.
+var engineNames = map[string]bool{
+	"GR3D_FREQ": true,
+	"GR3D":      true,
+	"EMC_FREQ":  true,
+	"VIC_FREQ":  true,
+	"VIC":       true,
+	"APE":       true,
+	"MSENC":     true,
+	"NVENC":     true,
+	"NVENC1":    true,
+	"NVDEC":     true,
+	"NVDEC1":    true,
+	"NVJPG":     true,
+	"NVJPG1":    true,
+	"OFA":       true,
+	"SE":        true,
+	"NVDLA0":    true,
+	"NVDLA1":    true,
+	"DLA0":      true,
+	"DLA1":      true,
+	"PVA0_FREQ": true,
+	"PVA0":      true,
+	"PVA1_FREQ": true,
+	"PVA1":      true,
+}
+
+// ParseError lists the tokens of a line the parser did not recognise.
+// The Sample returned alongside it still holds every field that was recognised.
+type ParseError struct {
+	Line   string
+	Tokens []string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("tegrastats: unrecognised tokens %q", e.Tokens)
+}
+
+// Parse turns one tegrastats line into a Sample in a single pass over its tokens.
+// Unrecognised tokens are skipped and reported through a *ParseError,
+// in which case the returned Sample is still usable.
+func Parse(line string) (*Sample, error) {
+	p := &parser{tokens: strings.Fields(line), sample: &Sample{}}
+	p.parse()
+	if len(p.unknown) > 0 {
+		return p.sample, &ParseError{Line: line, Tokens: p.unknown}
+	}
+	return p.sample, nil
+}
+
+type parser struct {
+	tokens  []string
+	pos     int
+	sample  *Sample
+	unknown []string
+}
+
+// peek returns the token offset positions after the current one without consuming it.
+func (p *parser) peek(offset int) string {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset]
+	}
+	return ""
+}
+
+func (p *parser) parse() {
+	p.parseTime()
+	for p.pos < len(p.tokens) {
+		token := p.tokens[p.pos]
+		var ok bool
+		switch {
+		case token == "RAM":
+			ok = p.parseMemory(&p.sample.RAM, "(lfb")
+		case token == "SWAP":
+			ok = p.parseMemory(&p.sample.Swap, "(cached")
+		case token == "IRAM":
+			ok = p.parseMemory(&p.sample.IRAM, "(lfb")
+		case token == "CPU":
+			// AGX Xavier also prints a power rail named CPU: "CPU 310/310".
+			ok = p.parseCPU() || p.parseRail(token)
+		case token == "MTS":
+			ok = p.parseMTS()
+		case engineNames[token]:
+			ok = p.parseEngine(token)
+		case temperatureRegexp.MatchString(token):
+			ok = p.parseTemperature(token)
+		case railNameRegexp.MatchString(token):
+			ok = p.parseRail(token)
+		}
+		if !ok {
+			p.unknown = append(p.unknown, token)
+			p.pos++
+		}
+	}
+}
+
+func (p *parser) parseTime() {
+	if len(p.tokens) < 2 {
+		return
+	}
+	t, err := time.ParseInLocation(TimeLayout, p.tokens[0]+" "+p.tokens[1], time.Local)
+	if err != nil {
+		return
+	}
+	p.sample.Time = t
+	p.sample.TimePresent = true
+	p.pos = 2
+}
+
+// parseMemory handles "RAM X/YMB (lfb NxZMB)", "SWAP X/YMB (cached ZMB)" and "IRAM X/YkB (lfb ZkB)".
+func (p *parser) parseMemory(m *Memory, detail string) bool {
+	params := memoryRegexp.FindStringSubmatch(p.peek(1))
+	if params == nil || (params[4] != "" && params[4] != detail) {
+		return false
+	}
+	m.Present = true
+	m.UsedBytes = toBytes(params[1], params[3])
+	m.TotalBytes = toBytes(params[2], params[3])
+	// Older releases glue the detail to the value: "IRAM 0/252kB(lfb 252kB)".
+	if params[4] != "" {
+		p.pos++
+	} else {
+		p.pos += 2
+		if p.peek(0) != detail {
+			return true
+		}
+	}
+	value := p.peek(1)
+	if params := lfbBlocksRegexp.FindStringSubmatch(value); params != nil && detail == "(lfb" {
+		m.LargestFreeBlocks, _ = strconv.ParseUint(params[1], 10, 64)
+		m.LargestFreeBlockBytes = toBytes(params[2], params[3])
+	} else if params := sizeRegexp.FindStringSubmatch(value); params != nil {
+		if detail == "(cached" {
+			m.CachedBytes = toBytes(params[1], params[2])
+		} else {
+			m.LargestFreeBlockBytes = toBytes(params[1], params[2])
+		}
+	} else {
+		return true
+	}
+	p.pos += 2
+	return true
+}
+
+// parseCPU handles "CPU [X%@Z,Y%@Z,off]" and the older "CPU [X%,Y%,off]@Z".
+func (p *parser) parseCPU() bool {
+	params := cpuRegexp.FindStringSubmatch(p.peek(1))
+	if params == nil {
+		return false
+	}
+	cpu := CPU{Present: true}
+	for i, value := range strings.Split(params[1], ",") {
+		core := Core{Index: i}
+		if value != "off" {
+			values := coreRegexp.FindStringSubmatch(value)
+			if values == nil {
+				return false
+			}
+			core.Online = true
+			core.LoadPercent = toFloat(values[1])
+			freq := values[2]
+			if freq == "" {
+				freq = params[2]
+			}
+			if freq != "" {
+				core.FrequencyPresent = true
+				core.FrequencyMHz = toFloat(freq)
+			}
+		}
+		cpu.Cores = append(cpu.Cores, core)
+	}
+	p.sample.CPU = cpu
+	p.pos += 2
+	return true
+}
+
+// parseMTS handles "MTS fg X% bg Y%".
+func (p *parser) parseMTS() bool {
+	fg := percentRegexp.FindStringSubmatch(p.peek(2))
+	bg := percentRegexp.FindStringSubmatch(p.peek(4))
+	if p.peek(1) != "fg" || p.peek(3) != "bg" || fg == nil || bg == nil {
+		return false
+	}
+	p.sample.MTS = MTS{
+		Present:           true,
+		ForegroundPercent: toFloat(fg[1]),
+		BackgroundPercent: toFloat(bg[1]),
+	}
+	p.pos += 5
+	return true
+}
+
+// parseEngine handles "NAME X%@Y", "NAME X%", "NAME Y", "NAME @Y" and "NAME off".
+// Orin boards print the GPU clock of every GPC instead: "GR3D_FREQ X%@[Y0,Y1]".
+func (p *parser) parseEngine(name string) bool {
+	value := p.peek(1)
+	engine := Engine{Name: name}
+	if value == "off" {
+		engine.Online = false
+	} else if params := engineRegexp.FindStringSubmatch(value); params != nil {
+		engine.Online = true
+		engine.UtilizationPresent = true
+		engine.UtilizationPercent = toFloat(params[1])
+		if strings.HasPrefix(params[2], "[") {
+			for _, freq := range strings.Split(strings.Trim(params[2], "[]"), ",") {
+				engine.GPCFrequenciesMHz = append(engine.GPCFrequenciesMHz, toFloat(freq))
+			}
+			engine.FrequencyPresent = true
+			engine.FrequencyMHz = highest(engine.GPCFrequenciesMHz)
+		} else if params[2] != "" {
+			engine.FrequencyPresent = true
+			engine.FrequencyMHz = toFloat(params[2])
+		}
+	} else if params := engineFreqRegexp.FindStringSubmatch(value); params != nil {
+		engine.Online = true
+		engine.FrequencyPresent = true
+		engine.FrequencyMHz = toFloat(params[1])
+	} else {
+		return false
+	}
+	if p.sample.Engines == nil {
+		p.sample.Engines = make(map[string]Engine)
+	}
+	p.sample.Engines[name] = engine
+	p.pos += 2
+	return true
+}
+
+// parseTemperature handles "NAME@XC".
+func (p *parser) parseTemperature(token string) bool {
+	params := temperatureRegexp.FindStringSubmatch(token)
+	if p.sample.Temps == nil {
+		p.sample.Temps = make(map[string]Temperature)
+	}
+	p.sample.Temps[params[1]] = Temperature{Name: params[1], Celsius: toFloat(params[2])}
+	p.pos++
+	return true
+}
+
+// parseRail handles "NAME X/Y" and the JetPack 5+ "NAME XmW/YmW", both in milliwatts.
+func (p *parser) parseRail(name string) bool {
+	params := railValueRegexp.FindStringSubmatch(p.peek(1))
+	if params == nil {
+		return false
+	}
+	if p.sample.Rails == nil {
+		p.sample.Rails = make(map[string]Rail)
+	}
+	p.sample.Rails[name] = Rail{
+		Name:              name,
+		CurrentMilliwatts: toFloat(params[1]),
+		AverageMilliwatts: toFloat(params[2]),
+	}
+	p.pos += 2
+	return true
+}
+
+// toBytes converts a tegrastats size, which uses binary multiples, into bytes.
+func toBytes(value, unit string) uint64 {
+	v, _ := strconv.ParseUint(value, 10, 64)
+	switch unit {
+	case "k", "K":
+		return v << 10
+	case "M":
+		return v << 20
+	case "G":
+		return v << 30
+	}
+	return v
+}
+
+func highest(values []float64) float64 {
+	var m float64
+	for i, v := range values {
+		if i == 0 || v > m {
+			m = v
+		}
+	}
+	return m
+}
+
+func toFloat(value string) float64 {
+	v, _ := strconv.ParseFloat(value, 64)
+	return v
+}
@@ -0,0 +1,101 @@
+package tegrastats
+
+import "time"
+
+// Sample is one parsed tegrastats line.
+// Every group carries a Present flag because the set of fields tegrastats
+// prints depends on the board and the JetPack release.
+type Sample struct {
+	// Time is the timestamp tegrastats printed in front of the line. When TimePresent is false,
+	// the exporter sources fill in the time they received the line instead.
+	Time        time.Time
+	TimePresent bool
+	// Recorded is the receive time a recording kept for a replayed sample, whose Time is
+	// the playback time; it is zero for every other sample. The parser never sets it.
+	Recorded time.Time `json:"-"`
+
+	RAM  Memory
+	Swap Memory
+	IRAM Memory
+	CPU  CPU
+	MTS  MTS
+
+	// Engines is keyed by the name tegrastats printed, e.g. "GR3D_FREQ" or "EMC_FREQ".
+	Engines map[string]Engine
+	// Rails is keyed by the rail name, e.g. "VDD_IN" or "POM_5V_GPU".
+	Rails map[string]Rail
+	// Temps is keyed by the thermal zone name, e.g. "GPU" or "AO".
+	Temps map[string]Temperature
+}
+
+// Memory is the RAM, SWAP or IRAM group.
+//
+//	RAM X/Y (lfb NxZ)
+//	SWAP X/Y (cached Z)
+//	IRAM X/Y (lfb Z)
+type Memory struct {
+	Present    bool
+	UsedBytes  uint64
+	TotalBytes uint64
+	// CachedBytes is only printed for SWAP.
+	CachedBytes uint64
+	// LargestFreeBlockBytes is the lfb size printed for RAM and IRAM.
+	LargestFreeBlockBytes uint64
+	// LargestFreeBlocks is the N in "lfb NxZ", only printed for RAM.
+	LargestFreeBlocks uint64
+}
+
+// CPU is the CPU [...] group.
+type CPU struct {
+	Present bool
+	Cores   []Core
+}
+
+// Core is one entry of the CPU [...] group.
+// An "off" entry has Online set to false and all other fields zero.
+type Core struct {
+	Index            int
+	Online           bool
+	LoadPercent      float64
+	FrequencyPresent bool
+	FrequencyMHz     float64
+}
+
+// MTS is the "MTS fg X% bg Y%" group printed by Tegra X1 based boards.
+type MTS struct {
+	Present           bool
+	ForegroundPercent float64
+	BackgroundPercent float64
+}
+
+// Engine is a hardware engine such as GR3D_FREQ (the GPU), EMC_FREQ (the memory controller),
+// NVENC/NVDEC/NVJPG (video and JPEG codecs), VIC, APE, NVDLA0 or PVA0.
+//
+//	NAME X%@Y, NAME X%, NAME Y or NAME off
+type Engine struct {
+	Name string
+	// Online is false when tegrastats printed "off".
+	Online             bool
+	UtilizationPresent bool
+	UtilizationPercent float64
+	FrequencyPresent   bool
+	// FrequencyMHz is the highest of GPCFrequenciesMHz on boards that print one clock per GPC.
+	FrequencyMHz float64
+	// GPCFrequenciesMHz is only printed for GR3D_FREQ on Orin boards.
+	GPCFrequenciesMHz []float64
+}
+
+// Rail is a power rail reading "NAME X/Y", or "NAME XmW/YmW" on JetPack 5 and later.
+type Rail struct {
+	Name string
+	// CurrentMilliwatts is the instantaneous power X.
+	CurrentMilliwatts float64
+	// AverageMilliwatts is the running average Y tegrastats keeps since it started.
+	AverageMilliwatts float64
+}
+
+// Temperature is a thermal zone reading "NAME@XC".
+type Temperature struct {
+	Name    string
+	Celsius float64
+}
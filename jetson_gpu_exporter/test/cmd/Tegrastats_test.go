@@ -1,44 +1,39 @@
 package cmd
 
 import (
-	"fmt"
-	"github.com/bearboy/jetson_prometheus_exporter/exporter"
-	"github.com/robfig/cron/v3"
-	"regexp"
 	"testing"
-	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
 )
 
 func TestGetSwap(t *testing.T) {
 	var str = "RAM 1728/7763MB (lfb 1117x4MB) IRAM 1728/7763MB (lfb 1117MB) SWAP 0/3882MB (cached 0MB) CPU [5%@1190,1%@1190,off,off,off,off] EMC_FREQ 0% GR3D_FREQ 0% AO@35.5C GPU@35.5C PMIC@100C AUX@35.5C CPU@36C thermal@35.65C VDD_IN 3757/3757 VDD_CPU_GPU_CV 197/197 VDD_SOC 1066/1066 MTS fg 12% bg 13% GR3D 14%@36"
-	matchRegxp := regexp.MustCompile("SWAP (\\d+)\\/(\\d+)(\\w)B( ?)\\(cached (\\d+)(\\w)B\\)")
-	params := matchRegxp.FindStringSubmatch(str)
-	for _, param := range params {
-		fmt.Println(param)
+	sample, err := tegrastats.Parse(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sample.Swap.Present || sample.Swap.UsedBytes != 0 || sample.Swap.TotalBytes != 3882<<20 || sample.Swap.CachedBytes != 0 {
+		t.Errorf("SWAP: got %+v", sample.Swap)
+	}
+	if sample.RAM.UsedBytes != 1728<<20 || sample.RAM.LargestFreeBlocks != 1117 {
+		t.Errorf("RAM: got %+v", sample.RAM)
+	}
+	if sample.IRAM.TotalBytes != 7763<<20 || sample.IRAM.LargestFreeBlockBytes != 1117<<20 {
+		t.Errorf("IRAM: got %+v", sample.IRAM)
+	}
+	if len(sample.CPU.Cores) != 6 || sample.CPU.Cores[0].LoadPercent != 5 || sample.CPU.Cores[5].Online {
+		t.Errorf("CPU: got %+v", sample.CPU)
+	}
+	if len(sample.Rails) != 3 || sample.Rails["VDD_SOC"].CurrentMilliwatts != 1066 {
+		t.Errorf("rails: got %+v", sample.Rails)
+	}
+	if len(sample.Temps) != 6 || sample.Temps["thermal"].Celsius != 35.65 {
+		t.Errorf("temperatures: got %+v", sample.Temps)
+	}
+	if sample.MTS.ForegroundPercent != 12 || sample.MTS.BackgroundPercent != 13 {
+		t.Errorf("MTS: got %+v", sample.MTS)
+	}
+	if gr3d := sample.Engines["GR3D"]; gr3d.UtilizationPercent != 14 || gr3d.FrequencyMHz != 36 {
+		t.Errorf("GR3D: got %+v", gr3d)
 	}
-	fmt.Println(exporter.GetSwap(str))
-
-	fmt.Println(exporter.GetRam(str))
-
-	fmt.Println(exporter.GetCpu(str))
-	fmt.Println(exporter.GetVdd(str))
-
-	fmt.Println(exporter.GetTemp(str))
-	fmt.Println(exporter.GetMTS(str))
-	fmt.Println(exporter.GetGR3D(str))
-	fmt.Println(exporter.GetIRam(str))
-	//c := cron.New(cron.WithSeconds(), cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)), cron.WithLogger(
-	//	cron.VerbosePrintfLogger(log.StandardLogger())))
-	c := cron.New(cron.WithSeconds())
-	i := 1
-	spec := fmt.Sprintf("0 0 */%d * * *", 1)
-	EntryID, err := c.AddFunc(spec, func() {
-		fmt.Println(time.Now(), "每5s一次----------------", i)
-		time.Sleep(time.Second * 60)
-		i++
-	})
-	fmt.Println(time.Now(), EntryID, err)
-
-	c.Start()
-	time.Sleep(time.Second * 30)
 }
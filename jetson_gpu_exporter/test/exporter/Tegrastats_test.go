@@ -0,0 +1,264 @@
+package exporter
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeTegrastats puts a tegrastats shell script running script first on PATH.
+func fakeTegrastats(t *testing.T, script string) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "tegrastats"), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// gatherValue returns the value of an unlabelled metric, or the sample count of a histogram,
+// or -1 when it is missing.
+func gatherValue(t *testing.T, c prometheus.Collector, name string) float64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		m := family.GetMetric()[0]
+		if m.GetCounter() != nil {
+			return m.GetCounter().GetValue()
+		}
+		if m.GetHistogram() != nil {
+			return float64(m.GetHistogram().GetSampleCount())
+		}
+		return m.GetGauge().GetValue()
+	}
+	return -1
+}
+
+func TestStreamRestartsExitedTegrastats(t *testing.T) {
+	fakeTegrastats(t, "echo 'RAM 1728/7763MB (lfb 1117x4MB) GPU@35.5C'\n")
+	source := &exporter.Tegrastats{Interval: 100, Mode: exporter.ModeStream}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gatherValue(t, source, "nvidia_jetson_tegrastats_restarts_total") < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("tegrastats was not restarted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if sample := source.Latest(); sample == nil || !sample.RAM.Present {
+		t.Errorf("expected the streamed sample, got %+v", sample)
+	}
+	if age := gatherValue(t, source, "nvidia_jetson_last_sample_age_seconds"); age < 0 || age > 5 {
+		t.Errorf("last_sample_age_seconds: got %v", age)
+	}
+}
+
+func TestStreamKeepsSampleOverGarbledLines(t *testing.T) {
+	fakeTegrastats(t, "echo 'RAM 1728/7763MB (lfb 1117x4MB) GPU@35.5C'; echo; echo '%%% garbage'; while true; do sleep 0.1; done\n")
+	source := &exporter.Tegrastats{Interval: 100, Mode: exporter.ModeStream}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+
+	for deadline := time.Now().Add(5 * time.Second); source.Latest() == nil; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no sample")
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if sample := source.Latest(); !sample.RAM.Present || sample.Temps["GPU"].Celsius != 35.5 {
+		t.Errorf("expected the last good sample, got %+v", sample)
+	}
+}
+
+func TestStreamStopTerminatesTegrastats(t *testing.T) {
+	fakeTegrastats(t, "while true; do echo 'GPU@35.5C'; sleep 0.1; done\n")
+	source := &exporter.Tegrastats{Interval: 100, Mode: exporter.ModeStream}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if up := gatherValue(t, source, "nvidia_jetson_tegrastats_up"); up != 1 {
+		t.Errorf("tegrastats_up: got %v, want 1", up)
+	}
+	source.Stop()
+	if up := gatherValue(t, source, "nvidia_jetson_tegrastats_up"); up != 0 {
+		t.Errorf("tegrastats_up after Stop: got %v, want 0", up)
+	}
+}
+
+func TestAttachReadsExternalLogfile(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "external.log")
+	lines := "RAM 1728/7763MB (lfb 1117x4MB) GPU@35.5C\nRAM 1800/7763MB (lfb 1117x4MB) GPU@36C\n"
+	if err := os.WriteFile(logFile, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &exporter.Tegrastats{Mode: exporter.ModeAttach, LogPath: logFile}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	if sample := source.Latest(); sample.Temps["GPU"].Celsius != 36 {
+		t.Errorf("expected the last line of %s, got %+v", logFile, sample)
+	}
+	if up := gatherValue(t, source, "nvidia_jetson_tegrastats_up"); up != -1 {
+		t.Errorf("tegrastats_up should not be exported in attach mode, got %v", up)
+	}
+}
+
+func TestAttachFollowsAppendedLines(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "external.log")
+	if err := os.WriteFile(logFile, []byte("GPU@35.5C\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &exporter.Tegrastats{Interval: 20, Mode: exporter.ModeAttach, LogPath: logFile}
+	var seen []float64
+	done := make(chan struct{})
+	source.Subscribe(func(sample *tegrastats.Sample) {
+		seen = append(seen, sample.Temps["GPU"].Celsius)
+		if len(seen) == 3 {
+			close(done)
+		}
+	})
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("GPU@36C\nGPU@")
+	f.Sync()
+	time.Sleep(50 * time.Millisecond)
+	f.WriteString("37C\n")
+	f.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected three samples, got %v", seen)
+	}
+	if seen[0] != 35.5 || seen[1] != 36 || seen[2] != 37 {
+		t.Errorf("got %v", seen)
+	}
+}
+
+func TestEnergySurvivesTegrastatsRestarts(t *testing.T) {
+	fakeTegrastats(t, "for i in 1 2 3 4 5; do echo 'VDD_IN 2000/2000'; sleep 0.1; done\n")
+	source := &exporter.Tegrastats{Interval: 100, Mode: exporter.ModeStream}
+	e, err := exporter.NewExporter(100, source, exporter.CollectorOptions{}, []string{"power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for gatherValue(t, source, "nvidia_jetson_tegrastats_restarts_total") < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("tegrastats was not restarted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	before := gatherValue(t, e.Collector, "nvidia_jetson_rail_energy_joules_total")
+	time.Sleep(700 * time.Millisecond)
+	after := gatherValue(t, e.Collector, "nvidia_jetson_rail_energy_joules_total")
+	// 2 W over the four intervals between the five samples of each run,
+	// plus one interval for the restart gap
+	if after <= before || after < 1.4 || after > 2.2 {
+		t.Errorf("energy should keep growing across the restart: %v J before, %v J after, want about 1.8 J", before, after)
+	}
+}
+
+func TestEnergyOutlivesSamplesWithoutRails(t *testing.T) {
+	source := &pushSource{}
+	e, err := exporter.NewExporter(1000, source, exporter.CollectorOptions{}, []string{"power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	source.push(t, "VDD_IN 1000/1000", start)
+	source.push(t, "VDD_IN 1000/1000", start.Add(time.Second))
+	source.push(t, "GPU@35C", start.Add(2*time.Second))
+	if got := gatherValue(t, e.Collector, "nvidia_jetson_rail_energy_joules_total"); got != 1 {
+		t.Errorf("energy after a sample without rails: got %v J, want 1 J", got)
+	}
+}
+
+func TestEnergyWithinOnePrintedSecond(t *testing.T) {
+	source := &pushSource{}
+	e, err := exporter.NewExporter(100, source, exporter.CollectorOptions{}, []string{"power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ten samples 100ms apart at 2 W all printed in the same second, then one at 0 W in the next
+	start := time.Date(2022, 8, 25, 10, 15, 1, 0, time.Local)
+	line := start.Format(tegrastats.TimeLayout) + " VDD_IN 2000/2000"
+	for i := 0; i < 10; i++ {
+		source.push(t, line, start)
+	}
+	next := start.Add(time.Second)
+	source.push(t, next.Format(tegrastats.TimeLayout)+" VDD_IN 0/1800", next)
+	if got := gatherValue(t, e.Collector, "nvidia_jetson_rail_energy_joules_total"); math.Abs(got-1.8) > 1e-9 {
+		t.Errorf("energy: got %v J, want 1.8 J", got)
+	}
+}
+
+func TestStaleSampleDropsHardwareMetrics(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "external.log")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.WriteFile(logFile, []byte(old.Format(tegrastats.TimeLayout)+" GPU@35.5C\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &exporter.Tegrastats{Interval: 20, Mode: exporter.ModeAttach, LogPath: logFile}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	c, err := exporter.NewCollector(source, exporter.CollectorOptions{StaleAfter: time.Minute}, []string{"thermal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gatherValue(t, c, "nvidia_jetson_last_sample_timestamp_seconds"); got != float64(old.Unix()) {
+		t.Errorf("last sample timestamp: got %v, want %v", got, old.Unix())
+	}
+	if got := gatherValue(t, c, "nvidia_jetson_temperature_celsius"); got != -1 {
+		t.Errorf("a stale temperature should not be exported, got %v", got)
+	}
+
+	// a line without a timestamp is as old as its receipt
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("GPU@36C\n")
+	f.Close()
+	for deadline := time.Now().Add(5 * time.Second); gatherValue(t, c, "nvidia_jetson_temperature_celsius") != 36; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the fresh sample was not exported")
+		}
+	}
+	if got := gatherValue(t, c, "nvidia_jetson_last_sample_timestamp_seconds"); time.Since(time.Unix(int64(got), 0)) > time.Minute {
+		t.Errorf("last sample timestamp should be the receive time, got %v", got)
+	}
+}
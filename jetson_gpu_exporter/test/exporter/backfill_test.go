@@ -0,0 +1,61 @@
+package exporter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+)
+
+func TestBackfill(t *testing.T) {
+	log := strings.Join([]string{
+		"08-25-2022 10:15:01 RAM 1728/7763MB (lfb 1117x4MB) GR3D_FREQ 10%@114 GPU@35.5C VDD_IN 4000/4000",
+		"RAM 1728/7763MB (lfb 1117x4MB) GR3D_FREQ 10%@114 GPU@35.5C VDD_IN 4000/4000",
+		"08-25-2022 10:15:02 RAM 1730/7763MB (lfb 1117x4MB) GR3D_FREQ 20%@114 GPU@36C VDD_IN 2000/3000",
+		"08-25-2022 10:15:02 RAM 1730/7763MB (lfb 1117x4MB) GR3D_FREQ 20%@114 GPU@36C VDD_IN 2000/3000",
+		"08-25-2022 10:15:03 RAM 1732/7763MB (lfb 1117x4MB) GR3D_FREQ 30%@114 GPU@37C VDD_IN 2000/2667",
+	}, "\n")
+	var out bytes.Buffer
+	n, err := exporter.Backfill(strings.NewReader(log), &out, exporter.CollectorOptions{}, []string{"ram", "gpu", "power", "thermal"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("converted %d lines, want 3 (one has no timestamp, one repeats the one before)", n)
+	}
+	text := out.String()
+	if !strings.HasSuffix(text, "# EOF\n") {
+		t.Errorf("output should end with # EOF")
+	}
+	for _, want := range []string{
+		`nvidia_jetson_memory_used_bytes{memory="ram"} 1.811939328e+09 1.661422501e+09`,
+		`nvidia_jetson_gpu_utilization_ratio 0.3 1.661422503e+09`,
+		`nvidia_jetson_temperature_celsius{zone="GPU"} 36.0 1.661422502e+09`,
+		`nvidia_jetson_rail_energy_joules_total{rail="VDD_IN"} 4.0 1.661422503e+09`,
+		`nvidia_jetson_gpu_utilization_sampled_ratio_count 3 1.661422503e+09`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(text, "nvidia_jetson_scrape_") {
+		t.Errorf("scrape metrics have no place in a backfill")
+	}
+
+	// every family is one block: its header once, followed by all its samples
+	seen := make(map[string]bool)
+	family := ""
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			family = strings.Fields(line)[2]
+			if seen[family] {
+				t.Errorf("family %s is split", family)
+			}
+			seen[family] = true
+		} else if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, family) {
+			t.Errorf("%q is outside its family %s", line, family)
+		}
+	}
+}
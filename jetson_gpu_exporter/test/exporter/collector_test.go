@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+)
+
+func TestCollectorNames(t *testing.T) {
+	want := []string{"cpu", "emc", "engine", "gpu", "iram", "mts", "power", "ram", "swap", "thermal"}
+	if got := exporter.CollectorNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, name := range want {
+		if !exporter.CollectorDefaultEnabled(name) {
+			t.Errorf("%s should be enabled by default", name)
+		}
+	}
+}
+
+func TestNewCollectorUnknownName(t *testing.T) {
+	if _, err := exporter.NewCollector(exporter.NewSysfs(1000, testPaths), exporter.CollectorOptions{Paths: testPaths}, []string{"ram", "nope"}); err == nil {
+		t.Error("expected an error for an unknown collector")
+	}
+}
+
+func TestCollectFilter(t *testing.T) {
+	source := exporter.NewSysfs(1000, testPaths)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	e, err := exporter.NewExporter(1000, source, exporter.CollectorOptions{Paths: testPaths}, []string{"power", "ram", "thermal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.InitPrometheus()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?collect[]=power&collect[]=thermal", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "nvidia_jetson_rail_power_watts{") || !strings.Contains(body, "nvidia_jetson_temperature_celsius{") {
+		t.Errorf("expected power and thermal metrics, got %d:\n%s", rec.Code, body)
+	}
+	if strings.Contains(body, "nvidia_jetson_memory_used_bytes{") || strings.Contains(body, "go_goroutines") {
+		t.Errorf("unexpected metrics outside the filter:\n%s", body)
+	}
+
+	for _, query := range []string{"collect[]=nope", "collect[]=power&collect[]=cpu"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestConcurrentScrapes(t *testing.T) {
+	source := exporter.NewSysfs(10, testPaths)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	e, err := exporter.NewExporter(10, source, exporter.CollectorOptions{Paths: testPaths}, exporter.CollectorNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.InitPrometheus()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+				if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "nvidia_jetson_memory_used_bytes{") {
+					t.Errorf("got %d:\n%s", rec.Code, rec.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestCPUWithoutGovernor guards against the cpu collector giving up on the remaining
+// cores when one of them has no cpufreq scaling_governor, as on testdata cpu2 and cpu3.
+func TestCPUWithoutGovernor(t *testing.T) {
+	recording := filepath.Join(t.TempDir(), "run.tsl")
+	if err := os.WriteFile(recording, []byte("CPU [5%@1190,6%@1190,7%@1190,8%@1190]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := exporter.NewReplay(recording, 1, false, 1000)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	e, err := exporter.NewExporter(1000, source, exporter.CollectorOptions{Paths: testPaths}, []string{"cpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.InitPrometheus()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`nvidia_jetson_cpu_scaling_governor_info{cpu="1",governor="performance"} 1`,
+		`nvidia_jetson_cpu_frequency_hertz{cpu="2"} 1.19e+09`,
+		`nvidia_jetson_cpu_utilization_ratio{cpu="3"} 0.08`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(body, `governor_info{cpu="3"`) {
+		t.Errorf("cpu3 has no governor and should not export one")
+	}
+}
@@ -0,0 +1,184 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+// pushSource is a Source handing the samples the test pushes to its subscribers.
+type pushSource struct {
+	mu     sync.Mutex
+	latest *tegrastats.Sample
+	subs   []func(*tegrastats.Sample)
+}
+
+func (s *pushSource) Start() error { return nil }
+func (s *pushSource) Stop()        {}
+
+func (s *pushSource) Latest() *tegrastats.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest
+}
+
+func (s *pushSource) Subscribe(fn func(*tegrastats.Sample)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, fn)
+}
+
+func (s *pushSource) push(t *testing.T, line string, at time.Time) {
+	sample, err := tegrastats.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample.Time = at
+	s.send(sample)
+}
+
+// send hands sample to the subscribers as it is.
+func (s *pushSource) send(sample *tegrastats.Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = sample
+	for _, fn := range s.subs {
+		fn(sample)
+	}
+}
+
+// influxStub is a stand-in InfluxDB failing the first failures writes with a 503.
+type influxStub struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+	query    string
+	auth     string
+	lines    []string
+}
+
+func (s *influxStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.requests <= s.failures {
+		http.Error(w, "not yet", http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Path != "/api/v2/write" {
+		http.NotFound(w, req)
+		return
+	}
+	s.query = req.URL.RawQuery
+	s.auth = req.Header.Get("Authorization")
+	body, _ := io.ReadAll(req.Body)
+	s.lines = append(s.lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const influxLine = "RAM 1728/7763MB (lfb 1117x4MB) CPU [12%@1479,off] GR3D_FREQ 34%@1109 VDD_IN 4950/4950 GPU@38.5C"
+
+func TestInfluxWritesEverySample(t *testing.T) {
+	stub := &influxStub{failures: 1}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	source := &pushSource{}
+	w, err := exporter.NewInflux(exporter.InfluxOptions{
+		URL:           server.URL,
+		Org:           "factory",
+		Bucket:        "jetson",
+		Token:         "secret",
+		Tags:          map[string]string{"host": "nx01", "site": "plant 2"},
+		FlushInterval: time.Hour,
+	}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	at := time.Unix(1700000000, 0)
+	source.push(t, influxLine, at)
+	source.push(t, "GPU@39C", at.Add(time.Second))
+	if err := w.Flush(context.Background()); err == nil {
+		t.Fatal("expected the first write to fail")
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_influx_buffered_samples"); got != 2 {
+		t.Errorf("buffered after the failure: got %v", got)
+	}
+	source.push(t, "GPU@40C", at.Add(2*time.Second))
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if stub.query != "bucket=jetson&org=factory&precision=ns" || stub.auth != "Token secret" {
+		t.Errorf("request: got query %q authorization %q", stub.query, stub.auth)
+	}
+	want := []string{
+		`jetson_memory,memory=ram,host=nx01,site=plant\ 2 used_bytes=1811939328i,total_bytes=8140095488i,lfb_bytes=4194304i,lfb_blocks=1117i 1700000000000000000`,
+		`jetson_cpu,core=0,host=nx01,site=plant\ 2 online=true,load_percent=12,frequency_mhz=1479 1700000000000000000`,
+		`jetson_cpu,core=1,host=nx01,site=plant\ 2 online=false 1700000000000000000`,
+		`jetson_engine,engine=GR3D_FREQ,host=nx01,site=plant\ 2 online=true,utilization_percent=34,frequency_mhz=1109 1700000000000000000`,
+		`jetson_rail,rail=VDD_IN,host=nx01,site=plant\ 2 current_mw=4950,average_mw=4950 1700000000000000000`,
+		`jetson_thermal,zone=GPU,host=nx01,site=plant\ 2 celsius=38.5 1700000000000000000`,
+		`jetson_thermal,zone=GPU,host=nx01,site=plant\ 2 celsius=39 1700000001000000000`,
+		`jetson_thermal,zone=GPU,host=nx01,site=plant\ 2 celsius=40 1700000002000000000`,
+	}
+	if strings.Join(stub.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(stub.lines, "\n"), strings.Join(want, "\n"))
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_influx_samples_written_total"); got != 3 {
+		t.Errorf("written samples: got %v", got)
+	}
+}
+
+func TestInfluxRejectsPointTags(t *testing.T) {
+	_, err := exporter.NewInflux(exporter.InfluxOptions{URL: "http://influxdb:8086", Bucket: "jetson", Tags: map[string]string{"zone": "a"}}, &pushSource{})
+	if err == nil {
+		t.Error("expected an error for a tag named like a point tag")
+	}
+}
+
+func TestServeInflux(t *testing.T) {
+	source := &pushSource{}
+	e, err := exporter.NewExporter(1000, source, exporter.CollectorOptions{Paths: testPaths}, []string{"thermal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeInflux(rec, httptest.NewRequest("GET", "/influx", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a sample: got %d", rec.Code)
+	}
+
+	source.push(t, influxLine, time.Unix(1700000000, 0))
+	rec = httptest.NewRecorder()
+	e.ServeInflux(rec, httptest.NewRequest("GET", "/influx", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(body, "jetson_memory,memory=ram,host=") || strings.Count(body, "\n") != 6 ||
+		!strings.Contains(body, " celsius=38.5 1700000000000000000\n") {
+		t.Errorf("got %d\n%s", rec.Code, body)
+	}
+
+	// the configured tags are served as well
+	if err := e.SetInfluxTags(map[string]string{"host": "nx01", "site": "plant 2"}); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeInflux(rec, httptest.NewRequest("GET", "/influx", nil))
+	if body := rec.Body.String(); !strings.HasPrefix(body, `jetson_memory,memory=ram,host=nx01,site=plant\ 2 `) {
+		t.Errorf("with tags: got\n%s", body)
+	}
+	if err := e.SetInfluxTags(map[string]string{"rail": "a"}); err == nil {
+		t.Error("expected an error for a tag named like a point tag")
+	}
+}
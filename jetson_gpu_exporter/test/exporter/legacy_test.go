@@ -0,0 +1,55 @@
+package exporter
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+)
+
+// legacyLine is a TX1 line with two rails of newer boards the first releases never matched.
+const legacyLine = "RAM 1034/3995MB (lfb 477x4MB) SWAP 0/0MB (cached 0MB) IRAM 0/252kB(lfb 252kB) CPU [4%@102,2%@102,off,off] " +
+	"EMC_FREQ 7%@40 GR3D_FREQ 0%@76 APE 25 MTS fg 0% bg 0% PLL@26.5C CPU@29C PMIC@100C GPU@27.5C AO@34C thermal@28.25C " +
+	"VDD_IN 2315/2315 VDD_CPU 75/75 VDD_GPU 19/19 POM_5V_IN 2188/2188 VIN_SYS_5V0 4000/4000"
+
+// TestLegacyExposition pins --metrics.legacy-names to what the exporter served before the
+// base-unit names: testdata/legacy.prom is the output of the first release for legacyLine,
+// with the governors of testdata/sys, less the zeros it sent for groups missing from the line
+// (nvidia_jetson_gr3d here).
+func TestLegacyExposition(t *testing.T) {
+	source := &pushSource{}
+	opts := exporter.CollectorOptions{Paths: testPaths, LegacyNames: true, StatsWindow: time.Minute}
+	collectors := []string{"cpu", "emc", "engine", "gpu", "iram", "mts", "power", "ram", "swap", "thermal"}
+	e, err := exporter.NewExporter(1000, source, opts, collectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.InitPrometheus()
+	source.push(t, legacyLine, time.Now())
+	source.push(t, legacyLine, time.Now())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var got []string
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// the self-metrics of the exporter are left out, they are the same in both schemas
+		if !strings.Contains(line, "nvidia_jetson_") || strings.Contains(line, "nvidia_jetson_scrape_") ||
+			strings.Contains(line, "nvidia_jetson_last_sample_") {
+			continue
+		}
+		got = append(got, line)
+	}
+	want, err := os.ReadFile("testdata/legacy.prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n")+"\n" != string(want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+}
@@ -0,0 +1,225 @@
+package exporter
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// broker is a stand-in MQTT broker recording the connects and publishes it receives.
+type broker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	connects []*packets.ConnectPacket
+	messages []*packets.PublishPacket
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		b.drop()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connects = append(b.connects, p)
+			b.mu.Unlock()
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.messages = append(b.messages, p)
+			b.mu.Unlock()
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// drop closes every client connection, like a broker restart.
+func (b *broker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// wait returns the nth message published to topic, counting from 1.
+func (b *broker) wait(t *testing.T, topic string, nth int) *packets.PublishPacket {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		b.mu.Lock()
+		n := 0
+		for _, m := range b.messages {
+			if m.TopicName == topic {
+				if n++; n == nth {
+					b.mu.Unlock()
+					return m
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+	t.Fatalf("no message %d on %s", nth, topic)
+	return nil
+}
+
+// attachedLog returns a source following a logfile and a function appending lines to it.
+func attachedLog(t *testing.T, first string) (exporter.Source, func(line string)) {
+	logFile := filepath.Join(t.TempDir(), "tegrastats.log")
+	if err := os.WriteFile(logFile, []byte(first+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &exporter.Tegrastats{Interval: 20, Mode: exporter.ModeAttach, LogPath: logFile}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(source.Stop)
+	return source, func(line string) {
+		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(line + "\n")
+		f.Close()
+	}
+}
+
+func TestMQTTPublishesSamples(t *testing.T) {
+	b := newBroker(t)
+	source, appendLine := attachedLog(t, "GR3D_FREQ 10%@114 GPU@35.5C")
+	m, err := exporter.NewMQTT(exporter.MQTTOptions{Broker: "tcp://" + b.ln.Addr().String(), Hostname: "nx01", QoS: 1}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+
+	if status := b.wait(t, "jetson/nx01/status", 1); string(status.Payload) != "online" || !status.Retain {
+		t.Errorf("status: got %q retained %v", status.Payload, status.Retain)
+	}
+	b.mu.Lock()
+	connect := b.connects[0]
+	b.mu.Unlock()
+	if !connect.WillFlag || connect.WillTopic != "jetson/nx01/status" || string(connect.WillMessage) != "offline" || !connect.WillRetain {
+		t.Errorf("last will: got %s", connect)
+	}
+
+	appendLine("GR3D_FREQ 20%@114 GPU@36C")
+	msg := b.wait(t, "jetson/nx01/stats", 1)
+	var sample map[string]interface{}
+	if err := json.Unmarshal(msg.Payload, &sample); err != nil {
+		t.Fatalf("payload %s: %s", msg.Payload, err)
+	}
+	if sample["hostname"] != "nx01" || sample["gr3d_freq_utilization_percent"] != 20.0 || sample["temp_gpu_celsius"] != 36.0 || sample["time"] == nil {
+		t.Errorf("sample: got %s", msg.Payload)
+	}
+	if msg.Qos != 1 {
+		t.Errorf("qos: got %d", msg.Qos)
+	}
+
+	// after a broker restart the exporter reconnects and is online again
+	b.drop()
+	b.wait(t, "jetson/nx01/status", 2)
+	appendLine("GR3D_FREQ 30%@114 GPU@37C")
+	b.wait(t, "jetson/nx01/stats", 2)
+
+	m.Stop()
+	if status := b.wait(t, "jetson/nx01/status", 3); string(status.Payload) != "offline" || !status.Retain {
+		t.Errorf("status after Stop: got %q retained %v", status.Payload, status.Retain)
+	}
+}
+
+func TestMQTTTopicPerMetric(t *testing.T) {
+	b := newBroker(t)
+	source, appendLine := attachedLog(t, "GPU@35.5C")
+	m, err := exporter.NewMQTT(exporter.MQTTOptions{
+		Broker:   "tcp://" + b.ln.Addr().String(),
+		Hostname: "nx01",
+		Topic:    "site/{hostname}/{metric}",
+	}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	b.wait(t, "jetson/nx01/status", 1)
+
+	appendLine("GR3D_FREQ 20%@114 GPU@36C")
+	if msg := b.wait(t, "site/nx01/temp_gpu_celsius", 1); string(msg.Payload) != "36" {
+		t.Errorf("temp_gpu_celsius: got %q", msg.Payload)
+	}
+	if msg := b.wait(t, "site/nx01/gr3d_freq_utilization_percent", 1); string(msg.Payload) != "20" {
+		t.Errorf("gr3d_freq_utilization_percent: got %q", msg.Payload)
+	}
+}
+
+func TestMQTTSkipsNonFiniteValues(t *testing.T) {
+	b := newBroker(t)
+	source := &pushSource{}
+	m, err := exporter.NewMQTT(exporter.MQTTOptions{Broker: "tcp://" + b.ln.Addr().String(), Hostname: "nx01"}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	b.wait(t, "jetson/nx01/status", 1)
+
+	source.send(&tegrastats.Sample{Temps: map[string]tegrastats.Temperature{
+		"GPU": {Name: "GPU", Celsius: math.NaN()},
+		"CPU": {Name: "CPU", Celsius: 36},
+		"AO":  {Name: "AO", Celsius: math.Inf(1)},
+	}})
+	msg := b.wait(t, "jetson/nx01/stats", 1)
+	var sample map[string]interface{}
+	if err := json.Unmarshal(msg.Payload, &sample); err != nil {
+		t.Fatalf("payload %s: %s", msg.Payload, err)
+	}
+	if _, ok := sample["temp_gpu_celsius"]; ok || sample["temp_cpu_celsius"] != 36.0 || len(sample) != 2 {
+		t.Errorf("sample: got %s", msg.Payload)
+	}
+}
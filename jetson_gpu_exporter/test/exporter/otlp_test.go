@@ -0,0 +1,187 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub is a stand-in OpenTelemetry Collector receiving OTLP over gRPC or HTTP.
+type collectorStub struct {
+	mu   sync.Mutex
+	grpc bool
+	// reject, when set, answers every gRPC request with this status and message
+	reject  [2]string
+	path    string
+	auth    string
+	request *metricspb.MetricsData
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path = req.URL.Path
+	c.auth = req.Header.Get("Authorization")
+	body, _ := io.ReadAll(req.Body)
+	if c.grpc {
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") || len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			http.Error(w, "not a grpc request", http.StatusBadRequest)
+			return
+		}
+		body = body[5:]
+		w.Header().Set("Content-Type", "application/grpc")
+		if c.reject[0] != "" {
+			w.Header().Set("Grpc-Status", c.reject[0])
+			w.Header().Set("Grpc-Message", c.reject[1])
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+	}
+	c.request = &metricspb.MetricsData{}
+	if err := proto.Unmarshal(body, c.request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if c.grpc {
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	}
+}
+
+// testRegistry returns a registry with a gauge, a counter and a histogram of the exporter.
+func testRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	temp := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nvidia_jetson_temperature_celsius", Help: "Temperature."}, []string{"zone"})
+	temp.WithLabelValues("GPU").Set(41.5)
+	energy := prometheus.NewCounter(prometheus.CounterOpts{Name: "nvidia_jetson_rail_energy_joules_total"})
+	energy.Add(12)
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "nvidia_jetson_gpu_utilization_sampled_ratio", Buckets: []float64{0.5, 1}})
+	hist.Observe(0.3)
+	hist.Observe(0.7)
+	reg.MustRegister(temp, energy, hist)
+	return reg
+}
+
+// boardPaths returns Paths of a fake Jetson Orin with L4T 35.4.1.
+func boardPaths(t *testing.T) exporter.Paths {
+	dir := t.TempDir()
+	paths := exporter.Paths{Sysfs: filepath.Join(dir, "sys"), Procfs: filepath.Join(dir, "proc"), Rootfs: dir}
+	os.MkdirAll(filepath.Join(dir, "proc", "device-tree"), 0755)
+	os.MkdirAll(filepath.Join(dir, "etc"), 0755)
+	os.WriteFile(filepath.Join(dir, "proc", "device-tree", "model"), []byte("Jetson AGX Orin Developer Kit\x00"), 0644)
+	os.WriteFile(filepath.Join(dir, "etc", "nv_tegra_release"), []byte("# R35 (release), REVISION: 4.1, GCID: 33958178, BOARD: t186ref, EABI: aarch64, DATE: Tue Aug  1 19:57:35 UTC 2023\n"), 0644)
+	return paths
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	stub := &collectorStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	o, err := exporter.NewOTLP(exporter.OTLPOptions{
+		Endpoint:           server.URL,
+		Protocol:           exporter.OTLPProtocolHTTP,
+		Headers:            map[string]string{"Authorization": "Bearer secret"},
+		ResourceAttributes: map[string]string{"deployment.environment": "plant-2"},
+		Paths:              boardPaths(t),
+	}, testRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stub.path != "/v1/metrics" || stub.auth != "Bearer secret" {
+		t.Errorf("request: got path %q authorization %q", stub.path, stub.auth)
+	}
+	if got := gatherValue(t, o, "nvidia_jetson_otlp_data_points_total"); got != 3 {
+		t.Errorf("data points: got %v", got)
+	}
+
+	rm := stub.request.ResourceMetrics[0]
+	resource := make(map[string]string)
+	for _, kv := range rm.Resource.Attributes {
+		resource[kv.Key] = kv.Value.GetStringValue()
+	}
+	hostname, _ := os.Hostname()
+	if resource["host.name"] != hostname || resource["device.model.name"] != "Jetson AGX Orin Developer Kit" ||
+		resource["jetson.l4t.version"] != "35.4.1" || resource["deployment.environment"] != "plant-2" {
+		t.Errorf("resource: got %v", resource)
+	}
+
+	metrics := make(map[string]*metricspb.Metric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	temp := metrics["nvidia_jetson_temperature_celsius"]
+	if temp == nil || temp.Unit != "Cel" || temp.GetGauge() == nil {
+		t.Fatalf("temperature: got %v", temp)
+	}
+	if p := temp.GetGauge().DataPoints[0]; p.GetAsDouble() != 41.5 || p.Attributes[0].Key != "zone" || p.Attributes[0].Value.GetStringValue() != "GPU" {
+		t.Errorf("temperature point: got %v", p)
+	}
+	energy := metrics["nvidia_jetson_rail_energy_joules"]
+	if energy == nil || energy.Unit != "J" || !energy.GetSum().GetIsMonotonic() ||
+		energy.GetSum().AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE ||
+		energy.GetSum().DataPoints[0].GetAsDouble() != 12 || energy.GetSum().DataPoints[0].StartTimeUnixNano == 0 {
+		t.Errorf("energy: got %v", energy)
+	}
+	hist := metrics["nvidia_jetson_gpu_utilization_sampled_ratio"].GetHistogram()
+	if hist == nil {
+		t.Fatal("no histogram")
+	}
+	if p := hist.DataPoints[0]; p.Count != 2 || len(p.ExplicitBounds) != 2 || len(p.BucketCounts) != 3 ||
+		p.BucketCounts[0] != 1 || p.BucketCounts[1] != 1 || p.BucketCounts[2] != 0 {
+		t.Errorf("histogram point: got %v", p)
+	}
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	stub := &collectorStub{grpc: true}
+	server := httptest.NewServer(h2c.NewHandler(stub, &http2.Server{}))
+	defer server.Close()
+
+	o, err := exporter.NewOTLP(exporter.OTLPOptions{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Insecure: true,
+		Paths:    boardPaths(t),
+	}, testRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stub.path != "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export" {
+		t.Errorf("path: got %q", stub.path)
+	}
+	if n := len(stub.request.ResourceMetrics[0].ScopeMetrics[0].Metrics); n != 3 {
+		t.Errorf("metrics: got %d", n)
+	}
+
+	// a server rejecting the export with a grpc status counts as a failure
+	stub.mu.Lock()
+	stub.reject = [2]string{"16", "missing%20token"}
+	stub.mu.Unlock()
+	if err := o.Export(context.Background()); err == nil || !strings.Contains(err.Error(), "missing token") {
+		t.Errorf("expected the grpc status as error, got %v", err)
+	}
+	if got := gatherValue(t, o, "nvidia_jetson_otlp_export_failures_total"); got != 1 {
+		t.Errorf("failures: got %v", got)
+	}
+}
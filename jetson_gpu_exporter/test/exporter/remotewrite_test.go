@@ -0,0 +1,437 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// receivedSeries is one decoded TimeSeries of a remote_write request.
+type receivedSeries struct {
+	labels    map[string]string
+	names     []string
+	value     float64
+	timestamp int64
+}
+
+// receiver is a stand-in remote_write endpoint failing the first failures requests with a 503.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+	auth     string
+	// series is the last request, batches are all of them
+	series  []receivedSeries
+	batches [][]receivedSeries
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	r.auth = req.Header.Get("Authorization")
+	if r.requests <= r.failures {
+		http.Error(w, "not yet", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected encoding", http.StatusBadRequest)
+		return
+	}
+	compressed, _ := io.ReadAll(req.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wr := dynamicpb.NewMessage(writeRequest)
+	if err := proto.Unmarshal(body, wr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.series = nil
+	series := field(wr, "timeseries").List()
+	for i := 0; i < series.Len(); i++ {
+		ts := series.Get(i).Message()
+		s := receivedSeries{labels: make(map[string]string)}
+		labels := field(ts, "labels").List()
+		for j := 0; j < labels.Len(); j++ {
+			l := labels.Get(j).Message()
+			name := field(l, "name").String()
+			s.labels[name] = field(l, "value").String()
+			s.names = append(s.names, name)
+			if len(l.GetUnknown()) > 0 {
+				http.Error(w, "unknown fields in a Label", http.StatusBadRequest)
+				return
+			}
+		}
+		samples := field(ts, "samples").List()
+		if samples.Len() != 1 {
+			http.Error(w, fmt.Sprintf("%d samples in a TimeSeries", samples.Len()), http.StatusBadRequest)
+			return
+		}
+		sample := samples.Get(0).Message()
+		s.value = field(sample, "value").Float()
+		s.timestamp = field(sample, "timestamp").Int()
+		if len(ts.GetUnknown()) > 0 || len(sample.GetUnknown()) > 0 {
+			http.Error(w, "unknown fields in a TimeSeries", http.StatusBadRequest)
+			return
+		}
+		r.series = append(r.series, s)
+	}
+	if len(wr.GetUnknown()) > 0 {
+		http.Error(w, "unknown fields in the WriteRequest", http.StatusBadRequest)
+		return
+	}
+	r.batches = append(r.batches, r.series)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeRequest describes prometheus.WriteRequest as prompb/remote.proto and prompb/types.proto
+// of Prometheus declare it, without the metadata and exemplars the exporter never sends.
+var writeRequest = func() protoreflect.MessageDescriptor {
+	repeated := func(name string, number int32, message string) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+			TypeName: proto.String(".prometheus." + message),
+		}
+	}
+	scalar := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("remote.proto"),
+		Package: proto.String("prometheus"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("WriteRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				repeated("timeseries", 1, "TimeSeries"),
+			}},
+			{Name: proto.String("TimeSeries"), Field: []*descriptorpb.FieldDescriptorProto{
+				repeated("labels", 1, "Label"),
+				repeated("samples", 2, "Sample"),
+			}},
+			{Name: proto.String("Label"), Field: []*descriptorpb.FieldDescriptorProto{
+				scalar("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				scalar("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+			{Name: proto.String("Sample"), Field: []*descriptorpb.FieldDescriptorProto{
+				scalar("value", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				scalar("timestamp", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			}},
+		},
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return file.Messages().ByName("WriteRequest")
+}()
+
+// field returns the value of the named field of m.
+func field(m protoreflect.Message, name string) protoreflect.Value {
+	return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+}
+
+func TestRemoteWrite(t *testing.T) {
+	rec := &receiver{failures: 1}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	temp := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nvidia_jetson_temperature_celsius"}, []string{"zone"})
+	temp.WithLabelValues("GPU").Set(41.5)
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "nvidia_jetson_gpu_utilization_sampled_ratio", Buckets: []float64{0.5, 1}})
+	hist.Observe(0.3)
+	reg.MustRegister(temp, hist)
+
+	w, err := exporter.NewRemoteWrite(exporter.RemoteWriteOptions{
+		URL:            server.URL,
+		Retries:        2,
+		Username:       "jetson",
+		Password:       "secret",
+		ExternalLabels: map[string]string{"device": "jetson-07", "zone": "ignored"},
+	}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec.requests != 2 {
+		t.Errorf("expected one retry after the 503, got %d requests", rec.requests)
+	}
+	if rec.auth != "Basic amV0c29uOnNlY3JldA==" {
+		t.Errorf("authorization: got %q", rec.auth)
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_retries_total"); got != 1 {
+		t.Errorf("retries: got %v", got)
+	}
+
+	byName := make(map[string][]receivedSeries)
+	for _, s := range rec.series {
+		byName[s.labels["__name__"]] = append(byName[s.labels["__name__"]], s)
+		for i := 1; i < len(s.names); i++ {
+			if s.names[i-1] >= s.names[i] {
+				t.Errorf("labels are not sorted: %v", s.names)
+			}
+		}
+		if s.labels["device"] != "jetson-07" || s.timestamp == 0 {
+			t.Errorf("series without external label or timestamp: %+v", s)
+		}
+	}
+	if s := byName["nvidia_jetson_temperature_celsius"]; len(s) != 1 || s[0].value != 41.5 || s[0].labels["zone"] != "GPU" {
+		t.Errorf("temperature: got %+v", s)
+	}
+	if s := byName["nvidia_jetson_gpu_utilization_sampled_ratio_bucket"]; len(s) != 3 || s[2].labels["le"] != "+Inf" || s[2].value != 1 {
+		t.Errorf("histogram buckets: got %+v", s)
+	}
+	if s := byName["nvidia_jetson_gpu_utilization_sampled_ratio_sum"]; len(s) != 1 || s[0].value != 0.3 {
+		t.Errorf("histogram sum: got %+v", s)
+	}
+}
+
+func TestRemoteWriteDropsAfterRetries(t *testing.T) {
+	rec := &receiver{failures: 100}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvidia_jetson_gpu_utilization_ratio"}))
+	w, err := exporter.NewRemoteWrite(exporter.RemoteWriteOptions{URL: server.URL, Retries: 1}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Push(context.Background()); err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	if rec.requests != 2 {
+		t.Errorf("expected one retry, got %d requests", rec.requests)
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_dropped_samples_total"); got != 1 {
+		t.Errorf("dropped samples: got %v", got)
+	}
+}
+
+func TestRemoteWriteQueueReplaysInOrder(t *testing.T) {
+	dir := t.TempDir()
+	down := &receiver{failures: 100}
+	server := httptest.NewServer(down)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	power := prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvidia_jetson_rail_power_watts"})
+	reg.MustRegister(power)
+	opts := exporter.RemoteWriteOptions{URL: server.URL, Interval: time.Hour, QueueDir: dir}
+	w, err := exporter.NewRemoteWrite(opts, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, watts := range []float64{1, 2, 3} {
+		power.Set(watts)
+		if err := w.Push(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_queue_samples"); got != 3 {
+		t.Errorf("queued samples: got %v", got)
+	}
+	w.Stop()
+
+	// a crash in the middle of an append leaves a torn record behind
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("segments: got %v", segments)
+	}
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+
+	// the uplink comes back after two more failures
+	up := &receiver{failures: 2}
+	server2 := httptest.NewServer(up)
+	defer server2.Close()
+	opts.URL = server2.URL
+	w, err = exporter.NewRemoteWrite(opts, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+	power.Set(4)
+	if err := w.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		up.mu.Lock()
+		got = got[:0]
+		for _, batch := range up.batches {
+			got = append(got, batch[0].value)
+		}
+		up.mu.Unlock()
+		if len(got) == 4 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(got) != 4 || got[0] != 1 || got[1] != 2 || got[2] != 3 || got[3] != 4 {
+		t.Fatalf("expected the queued batches in order, got %v", got)
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_queue_samples"); got != 0 {
+		t.Errorf("queued samples after the replay: got %v", got)
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_queue_lag_seconds"); got != 0 {
+		t.Errorf("lag after the replay: got %v", got)
+	}
+}
+
+func TestRemoteWriteQueueCountsRejectedReplays(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "out of bounds", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvidia_jetson_rail_power_watts"}))
+	w, err := exporter.NewRemoteWrite(exporter.RemoteWriteOptions{URL: server.URL, Interval: time.Hour, QueueDir: t.TempDir()}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// queued before the start, as after a restart
+	w.Push(context.Background())
+	w.Push(context.Background())
+	w.Start()
+	defer w.Stop()
+	for deadline := time.Now().Add(5 * time.Second); gatherValue(t, w, "nvidia_jetson_remote_write_queue_samples") != 0; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the queued samples were not replayed")
+		}
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_replay_rejected_samples_total"); got != 2 {
+		t.Errorf("rejected replayed samples: got %v", got)
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_dropped_samples_total"); got != 0 {
+		t.Errorf("dropped samples during the replay: got %v", got)
+	}
+
+	// once the queue drained a rejection is a live one again
+	time.Sleep(50 * time.Millisecond)
+	w.Push(context.Background())
+	for deadline := time.Now().Add(5 * time.Second); gatherValue(t, w, "nvidia_jetson_remote_write_dropped_samples_total") != 1; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the rejected live sample was not dropped")
+		}
+	}
+	if got := gatherValue(t, w, "nvidia_jetson_remote_write_replay_rejected_samples_total"); got != 2 {
+		t.Errorf("rejected replayed samples after the live push: got %v", got)
+	}
+}
+
+func TestRemoteWriteQueueDropsOldSamples(t *testing.T) {
+	rec := &receiver{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvidia_jetson_rail_power_watts"}))
+	w, err := exporter.NewRemoteWrite(exporter.RemoteWriteOptions{
+		URL:         server.URL,
+		Interval:    time.Hour,
+		QueueDir:    t.TempDir(),
+		QueueMaxAge: 10 * time.Millisecond,
+	}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Push(context.Background())
+	w.Push(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	w.Start()
+	defer w.Stop()
+	for deadline := time.Now().Add(5 * time.Second); gatherValue(t, w, "nvidia_jetson_remote_write_dropped_samples_total") != 2; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the expired samples were not dropped")
+		}
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.requests != 0 {
+		t.Errorf("expired samples should not be sent, got %d requests", rec.requests)
+	}
+}
+
+func TestRemoteWriteQueueBrokenCursor(t *testing.T) {
+	for _, cursor := range []string{"", "0"} {
+		dir := t.TempDir()
+		down := &receiver{failures: 100}
+		server := httptest.NewServer(down)
+		reg := prometheus.NewRegistry()
+		power := prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvidia_jetson_rail_power_watts"})
+		reg.MustRegister(power)
+		opts := exporter.RemoteWriteOptions{URL: server.URL, Interval: time.Hour, QueueDir: dir}
+		w, err := exporter.NewRemoteWrite(opts, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, watts := range []float64{1, 2} {
+			power.Set(watts)
+			w.Push(context.Background())
+		}
+		w.Stop()
+		server.Close()
+
+		// a power loss while the cursor was written leaves it empty or cut short
+		if err := os.WriteFile(filepath.Join(dir, "cursor"), []byte(cursor), 0644); err != nil {
+			t.Fatal(err)
+		}
+		up := &receiver{}
+		server = httptest.NewServer(up)
+		opts.URL = server.URL
+		w, err = exporter.NewRemoteWrite(opts, reg)
+		if err != nil {
+			t.Fatalf("cursor %q: %s", cursor, err)
+		}
+		w.Start()
+		for deadline := time.Now().Add(10 * time.Second); gatherValue(t, w, "nvidia_jetson_remote_write_queue_samples") != 0; time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("cursor %q: the queue was not sent", cursor)
+			}
+		}
+		w.Stop()
+		server.Close()
+		up.mu.Lock()
+		if len(up.batches) != 2 || up.batches[0][0].value != 1 || up.batches[1][0].value != 2 {
+			t.Errorf("cursor %q: expected the queue from its start, got %v", cursor, up.batches)
+		}
+		up.mu.Unlock()
+		if data, _ := os.ReadFile(filepath.Join(dir, "cursor")); len(data) == 0 {
+			t.Errorf("cursor %q: the cursor was not rewritten", cursor)
+		}
+	}
+}
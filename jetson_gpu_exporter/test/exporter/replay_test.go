@@ -0,0 +1,149 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	fakeTegrastats(t, "for t in 40 41 42; do echo \"GPU@${t}C\"; sleep 0.2; done; sleep 10\n")
+	recording := filepath.Join(t.TempDir(), "run.tsl")
+	file, err := os.Create(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	lines := 0
+	source := &exporter.Tegrastats{Interval: 200, Mode: exporter.ModeStream, Raw: func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		exporter.WriteRecord(file, time.Now(), line)
+		lines++
+	}}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		mu.Lock()
+		n := lines
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d lines, want 3", n)
+		}
+	}
+	source.Stop()
+	file.Close()
+
+	// the recording spans 400ms, at 4x it plays back in about 100ms
+	replay := exporter.NewReplay(recording, 4, false, 1000)
+	var temps []float64
+	done := make(chan struct{})
+	replay.Subscribe(func(sample *tegrastats.Sample) {
+		temps = append(temps, sample.Temps["GPU"].Celsius)
+		if len(temps) == 3 {
+			close(done)
+		}
+	})
+	begin := time.Now()
+	if err := replay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("replayed %v", temps)
+	}
+	if elapsed := time.Since(begin); elapsed < 80*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("replay at 4x took %s, want about 100ms", elapsed)
+	}
+	if temps[0] != 40 || temps[1] != 41 || temps[2] != 42 {
+		t.Errorf("got %v", temps)
+	}
+	if replay.Latest().Temps["GPU"].Celsius != 42 {
+		t.Errorf("the last sample should be kept at the end of the recording")
+	}
+}
+
+func TestReplayPlainLogfile(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "tegrastats.log")
+	if err := os.WriteFile(logFile, []byte("GPU@40C\nGPU@41C\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay := exporter.NewReplay(logFile, 100, true, 1000)
+	seen := make(chan float64, 16)
+	replay.Subscribe(func(sample *tegrastats.Sample) {
+		select {
+		case seen <- sample.Temps["GPU"].Celsius:
+		default:
+		}
+	})
+	if err := replay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Stop()
+	// lines without a receive time are 1s apart, 10ms at 100x; the loop starts over after the last one
+	for _, want := range []float64{40, 41, 40, 41} {
+		select {
+		case got := <-seen:
+			if got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("replay stalled")
+		}
+	}
+}
+
+func TestReplayEnergyFollowsRecordingClock(t *testing.T) {
+	// 1 W for the 5s the recording spans, played back at 10x in about 0.5s
+	var recording strings.Builder
+	start := time.Date(2022, 8, 29, 10, 15, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		exporter.WriteRecord(&recording, start.Add(time.Duration(i)*time.Second), "VDD_IN 1000/1000")
+	}
+	file := filepath.Join(t.TempDir(), "run.tsl")
+	if err := os.WriteFile(file, []byte(recording.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay := exporter.NewReplay(file, 10, false, 1000)
+	var mu sync.Mutex
+	played := 0
+	replay.Subscribe(func(*tegrastats.Sample) {
+		mu.Lock()
+		played++
+		mu.Unlock()
+	})
+	e, err := exporter.NewExporter(1000, replay, exporter.CollectorOptions{}, []string{"power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Stop()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		mu.Lock()
+		n := played
+		mu.Unlock()
+		if n == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("played %d samples, want 6", n)
+		}
+	}
+	if got := gatherValue(t, e.Collector, "nvidia_jetson_rail_energy_joules_total"); got != 5 {
+		t.Errorf("energy: got %v J, want 5 J", got)
+	}
+}
@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+)
+
+// testPaths points every collector at the fake filesystem tree in testdata.
+var testPaths = exporter.Paths{Sysfs: "testdata/sys", Procfs: "testdata/proc", Rootfs: "testdata"}
+
+func TestSysfsSample(t *testing.T) {
+	source := exporter.NewSysfs(1000, testPaths)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	sample := source.Latest()
+
+	if sample.RAM.TotalBytes != 7949560<<10 || sample.RAM.UsedBytes != (7949560-4194304-102400-1048576)<<10 {
+		t.Errorf("RAM: got %+v", sample.RAM)
+	}
+	if sample.Swap.UsedBytes != (3974776-3965560)<<10 || sample.Swap.CachedBytes != 2048<<10 {
+		t.Errorf("SWAP: got %+v", sample.Swap)
+	}
+	cores := sample.CPU.Cores
+	if len(cores) != 3 || !cores[1].Online || cores[1].FrequencyMHz != 2265.6 || cores[2].Online {
+		t.Errorf("CPU: got %+v", cores)
+	}
+	if gpu := sample.Engines["GR3D_FREQ"]; gpu.UtilizationPercent != 34.5 || gpu.FrequencyMHz != 318.75 {
+		t.Errorf("GR3D_FREQ: got %+v", gpu)
+	}
+	if sample.Temps["CPU"].Celsius != 36.5 || sample.Temps["tj"].Celsius != 41.25 {
+		t.Errorf("temperatures: got %+v", sample.Temps)
+	}
+	if rail, ok := sample.Rails["VDD_IN"]; !ok || rail.CurrentMilliwatts != 3760 || len(sample.Rails) != 1 {
+		t.Errorf("rails: got %+v", sample.Rails)
+	}
+}
+
+func TestSysfsWithoutInterval(t *testing.T) {
+	for _, interval := range []int{0, -1} {
+		source := exporter.NewSysfs(interval, testPaths)
+		if err := source.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if source.Latest() == nil {
+			t.Errorf("interval %d: no sample", interval)
+		}
+		source.Stop()
+	}
+}
+
+func TestExporterOnFakeFilesystem(t *testing.T) {
+	source := exporter.NewSysfs(1000, testPaths)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+
+	for _, tc := range []struct {
+		legacy bool
+		want   []string
+	}{
+		{false, []string{
+			`nvidia_jetson_cpu_online{cpu="2"} 0`,
+			`nvidia_jetson_cpu_frequency_hertz{cpu="1"} 2.2656e+09`,
+			`nvidia_jetson_cpu_scaling_governor_info{cpu="1",governor="performance"} 1`,
+			`nvidia_jetson_memory_total_bytes{memory="ram"} 8.14034944e+09`,
+			`nvidia_jetson_gpu_frequency_hertz 3.1875e+08`,
+			`nvidia_jetson_gpu_utilization_ratio 0.345`,
+			`nvidia_jetson_rail_power_watts{rail="VDD_IN"} 3.76`,
+			`nvidia_jetson_temperature_celsius{zone="tj"} 41.25`,
+		}},
+		{true, []string{
+			`nvidia_jetson_cpu{number="0",statistic="governor"} 0`,
+			`nvidia_jetson_cpu{number="1",statistic="governor"} 1`,
+			`nvidia_jetson_grd3_freq{statistic="frequency"} 318.75`,
+			`nvidia_jetson_vdd{label="IN",statistic="current"} 3760`,
+			`nvidia_jetson_temp{statistic="tj"} 41.25`,
+		}},
+	} {
+		opts := exporter.CollectorOptions{Paths: testPaths, LegacyNames: tc.legacy}
+		e, err := exporter.NewExporter(1000, source, opts, exporter.CollectorNames())
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.InitPrometheus()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+		want := append(tc.want,
+			`nvidia_jetson_scrape_collector_success{collector="ram"} 1`,
+			`nvidia_jetson_scrape_collector_success{collector="iram"} 0`,
+		)
+		for _, want := range want {
+			if !strings.Contains(body, want) {
+				t.Errorf("legacy names %v: missing %s", tc.legacy, want)
+			}
+		}
+	}
+}
+
+func TestTegrastatsBinaryUnderRootfs(t *testing.T) {
+	if !(&exporter.Tegrastats{Paths: testPaths}).Available() {
+		t.Error("expected testdata/usr/bin/tegrastats to be found")
+	}
+	if (&exporter.Tegrastats{Binary: "testdata/missing/tegrastats", Paths: testPaths}).Available() {
+		t.Error("an explicit binary that does not exist should not be available")
+	}
+}
+
+func TestSampledStatistics(t *testing.T) {
+	source := exporter.NewSysfs(10, testPaths)
+	opts := exporter.CollectorOptions{Paths: testPaths, StatsWindow: time.Second}
+	e, err := exporter.NewExporter(10, source, opts, []string{"gpu", "power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	time.Sleep(200 * time.Millisecond)
+	e.InitPrometheus()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`nvidia_jetson_gpu_utilization_sampled_ratio_bucket{le="0.3"} 0`,
+		`nvidia_jetson_gpu_utilization_min_ratio 0.345`,
+		`nvidia_jetson_gpu_utilization_max_ratio 0.345`,
+		`nvidia_jetson_rail_power_avg_watts{rail="VDD_IN"} 3.76`,
+		`nvidia_jetson_rail_power_sampled_watts_bucket{rail="VDD_IN",le="4"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if count := gatherValue(t, e.Collector, "nvidia_jetson_gpu_utilization_sampled_ratio"); count < 5 {
+		t.Errorf("expected a sample every 10ms in the histogram, got %v", count)
+	}
+}
@@ -0,0 +1,85 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/exporter"
+	"github.com/bearboy/jetson_prometheus_exporter/simulator"
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEveryBoardAndPatternParses(t *testing.T) {
+	start := time.Date(2024, 4, 22, 14, 45, 52, 0, time.Local)
+	for _, name := range simulator.BoardNames() {
+		board := simulator.Boards[name]
+		for _, pattern := range simulator.PatternNames() {
+			g := simulator.NewGenerator(board, simulator.Patterns[pattern], 1, start)
+			for i := 0; i < 120; i++ {
+				line := g.Line(start.Add(time.Duration(i) * time.Second))
+				sample, err := tegrastats.Parse(line)
+				if err != nil {
+					t.Fatalf("%s/%s: %s\n%s", name, pattern, err, line)
+				}
+				if len(sample.CPU.Cores) != board.Cores || len(sample.Rails) != len(board.Rails) ||
+					len(sample.Temps) != len(board.Temps) || sample.TimePresent != board.Timestamp {
+					t.Fatalf("%s/%s: got %+v from\n%s", name, pattern, sample, line)
+				}
+				if gpu := sample.Engines["GR3D_FREQ"]; len(gpu.GPCFrequenciesMHz) != board.GPCs {
+					t.Fatalf("%s/%s: got GPC clocks %v, want %d", name, pattern, gpu.GPCFrequenciesMHz, board.GPCs)
+				}
+			}
+		}
+	}
+}
+
+func TestSoakHeatsUp(t *testing.T) {
+	start := time.Now()
+	g := simulator.NewGenerator(simulator.Boards["xavier-nx"], simulator.Patterns["soak"], 1, start)
+	first, _ := tegrastats.Parse(g.Line(start))
+	var last *tegrastats.Sample
+	for i := 1; i <= 600; i++ {
+		last, _ = tegrastats.Parse(g.Line(start.Add(time.Duration(i) * time.Second)))
+	}
+	if rise := last.Temps["GPU"].Celsius - first.Temps["GPU"].Celsius; rise < 20 {
+		t.Errorf("a 10 minute soak should heat the GPU by about 24C, got %.1fC", rise)
+	}
+	if gpu := last.Engines["GR3D_FREQ"]; gpu.UtilizationPercent < 95 {
+		t.Errorf("soak should saturate the GPU, got %+v", gpu)
+	}
+}
+
+func TestBurstyHasBursts(t *testing.T) {
+	start := time.Now()
+	g := simulator.NewGenerator(simulator.Boards["agx-orin"], simulator.Patterns["bursty"], 1, start)
+	busy, idle := 0, 0
+	for i := 0; i < 600; i++ {
+		sample, _ := tegrastats.Parse(g.Line(start.Add(time.Duration(i) * 100 * time.Millisecond)))
+		if sample.Engines["GR3D_FREQ"].UtilizationPercent > 90 {
+			busy++
+		} else {
+			idle++
+		}
+	}
+	if busy == 0 || busy > idle {
+		t.Errorf("expected short GPU bursts between idle periods, got %d busy and %d idle samples", busy, idle)
+	}
+}
+
+func TestSimulatorSource(t *testing.T) {
+	source := exporter.NewSimulator(10, "nano", "ramp", 1)
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	if sample := source.Latest(); !sample.IRAM.Present || !sample.MTS.Present || len(sample.CPU.Cores) != 4 {
+		t.Errorf("expected a Nano sample, got %+v", sample)
+	}
+	if n := testutil.CollectAndCount(source, "nvidia_jetson_last_sample_age_seconds"); n != 1 {
+		t.Errorf("last_sample_age_seconds: got %d series", n)
+	}
+	if err := exporter.NewSimulator(10, "nope", "ramp", 1).Start(); err == nil {
+		t.Error("expected an error for an unknown board")
+	}
+}
@@ -0,0 +1,120 @@
+package tegrastats
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+// readFixture returns the lines of a testdata file, one tegrastats sample per line.
+func readFixture(t *testing.T, name string) []string {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestParseBoardFixtures(t *testing.T) {
+	tests := []struct {
+		file  string
+		cores int
+		rails []string
+		temps []string
+		gpcs  int
+	}{
+		{"nano.log", 4, []string{"POM_5V_IN", "POM_5V_GPU", "POM_5V_CPU"}, []string{"PLL", "GPU", "thermal"}, 0},
+		{"tx2.log", 6, []string{"VDD_SYS_GPU", "VDD_IN", "VDD_SYS_DDR"}, []string{"MCPU", "BCPU", "Tdiode"}, 0},
+		{"agx_xavier.log", 8, []string{"GPU", "CPU", "SOC", "SYS5V"}, []string{"AO", "Tdiode", "Tboard"}, 0},
+		{"xavier_nx.log", 6, []string{"VDD_IN", "VDD_CPU_GPU_CV", "VDD_SOC"}, []string{"AO", "AUX", "thermal"}, 0},
+		{"agx_orin.log", 12, []string{"VDD_GPU_SOC", "VDD_CPU_CV", "VIN_SYS_5V0", "VDDQ_VDD2_1V8AO"}, []string{"tj", "CV1", "tboard"}, 2},
+		{"orin_nano.log", 6, []string{"VDD_IN", "VDD_CPU_GPU_CV", "VDD_SOC"}, []string{"tj", "cpu", "gpu"}, 1},
+	}
+	for _, tt := range tests {
+		for i, line := range readFixture(t, tt.file) {
+			sample, err := tegrastats.Parse(line)
+			if err != nil {
+				t.Errorf("%s:%d: %s", tt.file, i+1, err)
+				continue
+			}
+			if !sample.RAM.Present || !sample.Swap.Present {
+				t.Errorf("%s:%d: RAM and SWAP should be present", tt.file, i+1)
+			}
+			if len(sample.CPU.Cores) != tt.cores {
+				t.Errorf("%s:%d: got %d cores, want %d", tt.file, i+1, len(sample.CPU.Cores), tt.cores)
+			}
+			for _, name := range tt.rails {
+				if _, ok := sample.Rails[name]; !ok {
+					t.Errorf("%s:%d: missing rail %s", tt.file, i+1, name)
+				}
+			}
+			for _, name := range tt.temps {
+				if _, ok := sample.Temps[name]; !ok {
+					t.Errorf("%s:%d: missing temperature %s", tt.file, i+1, name)
+				}
+			}
+			gpu := sample.Engines["GR3D_FREQ"]
+			if len(gpu.GPCFrequenciesMHz) != tt.gpcs {
+				t.Errorf("%s:%d: got GPC frequencies %v, want %d", tt.file, i+1, gpu.GPCFrequenciesMHz, tt.gpcs)
+			}
+		}
+	}
+}
+
+func TestParseOrinUnits(t *testing.T) {
+	sample, err := tegrastats.Parse(readFixture(t, "agx_orin.log")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rail := sample.Rails["VDD_GPU_SOC"]; rail.CurrentMilliwatts != 9588 || rail.AverageMilliwatts != 6193 {
+		t.Errorf("VDD_GPU_SOC: got %+v", rail)
+	}
+	if gpu := sample.Engines["GR3D_FREQ"]; gpu.UtilizationPercent != 87 || gpu.FrequencyMHz != 1300 {
+		t.Errorf("GR3D_FREQ: got %+v", gpu)
+	}
+	if temp := sample.Temps["CV1"]; temp.Celsius != -256 {
+		t.Errorf("CV1: got %+v", temp)
+	}
+}
+
+func TestParseEngines(t *testing.T) {
+	tests := []struct {
+		file string
+		line int
+		name string
+		want tegrastats.Engine
+	}{
+		{"tx2.log", 0, "APE", tegrastats.Engine{Name: "APE", Online: true, FrequencyPresent: true, FrequencyMHz: 150}},
+		{"agx_xavier.log", 0, "NVENC", tegrastats.Engine{Name: "NVENC", Online: true, FrequencyPresent: true, FrequencyMHz: 1190}},
+		{"agx_xavier.log", 1, "NVDEC", tegrastats.Engine{Name: "NVDEC"}},
+		{"agx_xavier.log", 1, "VIC_FREQ", tegrastats.Engine{Name: "VIC_FREQ", Online: true, UtilizationPresent: true, UtilizationPercent: 12, FrequencyPresent: true, FrequencyMHz: 601}},
+		{"agx_xavier.log", 1, "NVDLA0", tegrastats.Engine{Name: "NVDLA0", Online: true, FrequencyPresent: true, FrequencyMHz: 1395}},
+		{"agx_orin.log", 0, "NVJPG1", tegrastats.Engine{Name: "NVJPG1"}},
+		{"agx_orin.log", 1, "PVA0_FREQ", tegrastats.Engine{Name: "PVA0_FREQ", Online: true, FrequencyPresent: true, FrequencyMHz: 1152}},
+		{"agx_orin.log", 1, "VIC", tegrastats.Engine{Name: "VIC", Online: true, UtilizationPresent: true, FrequencyPresent: true, FrequencyMHz: 729}},
+	}
+	for _, tt := range tests {
+		sample, err := tegrastats.Parse(readFixture(t, tt.file)[tt.line])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := sample.Engines[tt.name]
+		if !ok || got.Name != tt.want.Name || got.Online != tt.want.Online ||
+			got.UtilizationPresent != tt.want.UtilizationPresent || got.UtilizationPercent != tt.want.UtilizationPercent ||
+			got.FrequencyPresent != tt.want.FrequencyPresent || got.FrequencyMHz != tt.want.FrequencyMHz {
+			t.Errorf("%s:%d %s: got %+v, want %+v", tt.file, tt.line+1, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package tegrastats
+
+import (
+	"testing"
+
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+func TestFlatten(t *testing.T) {
+	sample, err := tegrastats.Parse(readFixture(t, "agx_orin.log")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := tegrastats.Flatten(sample)
+	values := make(map[string]float64)
+	for i, field := range fields {
+		if _, ok := values[field.Name]; ok {
+			t.Errorf("duplicate column %s", field.Name)
+		}
+		values[field.Name] = field.Value
+		if i == 0 && field.Name != "ram_used_bytes" {
+			t.Errorf("columns should start with RAM, got %s", field.Name)
+		}
+	}
+	for name, want := range map[string]float64{
+		"ram_used_bytes":                2851 << 20,
+		"cpu3_online":                   0,
+		"cpu0_frequency_mhz":            2201,
+		"gr3d_freq_utilization_percent": 87,
+		"gr3d_freq_gpc1_frequency_mhz":  1300,
+		"nvjpg_online":                  0,
+		"vdd_gpu_soc_current_mw":        9588,
+		"vdd_gpu_soc_average_mw":        6193,
+		"temp_cv1_celsius":              -256,
+	} {
+		if got, ok := values[name]; !ok || got != want {
+			t.Errorf("%s: got %v (present %v), want %v", name, got, ok, want)
+		}
+	}
+
+	again := tegrastats.Flatten(sample)
+	for i := range fields {
+		if fields[i] != again[i] {
+			t.Fatalf("column %d: got %s then %s, the order should be stable", i, fields[i].Name, again[i].Name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tegrastats
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden from the current parser")
+
+func TestMain(m *testing.M) {
+	// the golden files hold the timestamps tegrastats printed, which Parse reads in the local time zone
+	time.Local = time.UTC
+	os.Exit(m.Run())
+}
+
+// TestParseGolden parses every line of every testdata/*.log and compares the samples with
+// testdata/golden/<name>.json. Run go test -update after an intended change of the parser.
+func TestParseGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no testdata/*.log")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".log")
+		var samples []*tegrastats.Sample
+		for i, line := range readFixture(t, filepath.Base(file)) {
+			sample, err := tegrastats.Parse(line)
+			if err != nil {
+				t.Errorf("%s:%d: %s", file, i+1, err)
+			}
+			samples = append(samples, sample)
+		}
+		got, err := json.MarshalIndent(samples, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, '\n')
+		golden := filepath.Join("testdata", "golden", name+".json")
+		if *update {
+			if err := os.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s, run go test -update to create it", err)
+		}
+		if !bytes.Equal(got, want) {
+			var wantSamples []*tegrastats.Sample
+			json.Unmarshal(want, &wantSamples)
+			for i := range samples {
+				if i >= len(wantSamples) || !reflect.DeepEqual(normalize(samples[i]), normalize(wantSamples[i])) {
+					t.Errorf("%s:%d: parsed sample differs from %s", file, i+1, golden)
+				}
+			}
+			t.Errorf("%s does not match the parser output, run go test -update if the change is intended", golden)
+		}
+	}
+}
+
+// normalize drops the monotonic clock reading so samples decoded from JSON compare equal.
+func normalize(sample *tegrastats.Sample) *tegrastats.Sample {
+	if sample == nil {
+		return nil
+	}
+	s := *sample
+	s.Time = s.Time.Round(0).UTC()
+	return &s
+}
+
+// FuzzParse checks that Parse never panics and always returns the same sample for the same line.
+func FuzzParse(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.log"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			f.Add(line)
+		}
+	}
+	f.Add("RAM 0/252kB(lfb")
+	f.Add("CPU [off,]@")
+	f.Add("GR3D_FREQ 1%@[,]")
+	f.Fuzz(func(t *testing.T, line string) {
+		sample, err := tegrastats.Parse(line)
+		if sample == nil {
+			t.Fatalf("Parse(%q) returned a nil sample", line)
+		}
+		again, _ := tegrastats.Parse(line)
+		if !reflect.DeepEqual(sample, again) {
+			t.Fatalf("Parse(%q) is not deterministic", line)
+		}
+		if err != nil && len(err.(*tegrastats.ParseError).Tokens) == 0 {
+			t.Fatalf("Parse(%q) returned an error without unrecognised tokens", line)
+		}
+		for name, rail := range sample.Rails {
+			if rail.Name != name {
+				t.Fatalf("Parse(%q): rail %s is named %s", line, name, rail.Name)
+			}
+		}
+		for i, core := range sample.CPU.Cores {
+			if core.Index != i {
+				t.Fatalf("Parse(%q): core %d has index %d", line, i, core.Index)
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package tegrastats
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bearboy/jetson_prometheus_exporter/tegrastats"
+)
+
+func TestParseXavierNX(t *testing.T) {
+	line := "08-25-2022 10:15:01 RAM 1728/7763MB (lfb 1117x4MB) SWAP 10/3882MB (cached 2MB) CPU [5%@1190,1%@1190,off,off,off,off] EMC_FREQ 3%@1600 GR3D_FREQ 0%@114 AO@35.5C GPU@35.5C PMIC@100C thermal@35.65C VDD_IN 3757/3757 VDD_CPU_GPU_CV 197/197 VDD_SOC 1066/1066"
+	sample, err := tegrastats.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sample.TimePresent || sample.Time.Day() != 25 || sample.Time.Second() != 1 {
+		t.Errorf("time: got %v", sample.Time)
+	}
+	if !sample.RAM.Present || sample.RAM.UsedBytes != 1728<<20 || sample.RAM.TotalBytes != 7763<<20 ||
+		sample.RAM.LargestFreeBlocks != 1117 || sample.RAM.LargestFreeBlockBytes != 4<<20 {
+		t.Errorf("RAM: got %+v", sample.RAM)
+	}
+	if !sample.Swap.Present || sample.Swap.UsedBytes != 10<<20 || sample.Swap.CachedBytes != 2<<20 {
+		t.Errorf("SWAP: got %+v", sample.Swap)
+	}
+	if sample.IRAM.Present || sample.MTS.Present {
+		t.Errorf("IRAM and MTS should be absent")
+	}
+	if len(sample.CPU.Cores) != 6 || !sample.CPU.Cores[1].Online || sample.CPU.Cores[1].FrequencyMHz != 1190 || sample.CPU.Cores[2].Online {
+		t.Errorf("CPU: got %+v", sample.CPU)
+	}
+	if emc := sample.Engines["EMC_FREQ"]; emc.UtilizationPercent != 3 || emc.FrequencyMHz != 1600 {
+		t.Errorf("EMC_FREQ: got %+v", emc)
+	}
+	if temp := sample.Temps["thermal"]; temp.Celsius != 35.65 {
+		t.Errorf("thermal: got %+v", temp)
+	}
+	if rail := sample.Rails["VDD_CPU_GPU_CV"]; rail.CurrentMilliwatts != 197 || rail.AverageMilliwatts != 197 {
+		t.Errorf("VDD_CPU_GPU_CV: got %+v", rail)
+	}
+}
+
+func TestParseLegacyCpuFrequency(t *testing.T) {
+	sample, err := tegrastats.Parse("RAM 2011/3964MB (lfb 9x4MB) IRAM 0/252kB(lfb 252kB) CPU [11%,9%,off,off]@1428 EMC_FREQ 4%@1600 GR3D_FREQ 0%@76 MTS fg 0% bg 0%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sample.IRAM.Present || sample.IRAM.TotalBytes != 252<<10 || sample.IRAM.LargestFreeBlockBytes != 252<<10 {
+		t.Errorf("IRAM: got %+v", sample.IRAM)
+	}
+	if core := sample.CPU.Cores[1]; core.LoadPercent != 9 || core.FrequencyMHz != 1428 {
+		t.Errorf("CPU 1: got %+v", core)
+	}
+	if !sample.MTS.Present {
+		t.Errorf("MTS should be present")
+	}
+}
+
+func TestParseUnrecognisedTokens(t *testing.T) {
+	sample, err := tegrastats.Parse("RAM 2011/3964MB (lfb 9x4MB) FOO bar GPU@40C")
+	var parseErr *tegrastats.ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	if len(parseErr.Tokens) != 2 || parseErr.Tokens[0] != "FOO" || parseErr.Tokens[1] != "bar" {
+		t.Errorf("tokens: got %q", parseErr.Tokens)
+	}
+	if !sample.RAM.Present || sample.Temps["GPU"].Celsius != 40 {
+		t.Errorf("recognised fields should still be parsed: got %+v", sample)
+	}
+}